@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// Subcommands run instead of the server when named as the first argument
+var commands = map[string]func(args []string) int{
+	"validate":     validateCommand,
+	"convert":      convertCommand,
+	"print-config": printConfigCommand,
+}
+
+// validateCommand checks a configuration file and reports every problem in it
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPtr, overrides := configFlags(flags)
+	_ = flags.Parse(args)
+
+	_, problems, err := types.ValidateConfigFile(*configPtr, overrides()...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *configPtr+": "+err.Error())
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println(*configPtr + ": OK")
+	return 0
+}
+
+// convertCommand translates a configuration file between JSON, YAML and TOML
+func convertCommand(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	configPtr := flags.String("config", "config.json", "Config File Path")
+	outPtr := flags.String("out", "", "Output File Path; written to stdout if empty")
+	formatPtr := flags.String("format", "", "Output format (json, yaml or toml); taken from -out if empty")
+	_ = flags.Parse(args)
+
+	format := *formatPtr
+	if format == "" && *outPtr != "" {
+		var err error
+		format, err = types.ConfigFormat(*outPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if format == "" {
+		fmt.Fprintln(os.Stderr, "convert needs -out or -format")
+		return 1
+	}
+
+	configData, _, err := types.DecodeConfigFile(*configPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *configPtr+": "+err.Error())
+		return 1
+	}
+	converted, err := types.EncodeConfig(configData, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *outPtr == "" {
+		_, err = os.Stdout.Write(converted)
+	} else {
+		err = os.WriteFile(*outPtr, converted, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// printConfigCommand prints the configuration the server would run with after
+// environment and flag overrides.  Registers from registers_csv, included files
+// and device templates are included inline so the output is a complete
+// configuration file.
+func printConfigCommand(args []string) int {
+	flags := flag.NewFlagSet("print-config", flag.ExitOnError)
+	configPtr, overrides := configFlags(flags)
+	formatPtr := flags.String("format", types.FormatJson, "Output format (json, yaml or toml)")
+	_ = flags.Parse(args)
+
+	configData, problems, err := types.ValidateConfigFile(*configPtr, overrides()...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *configPtr+": "+err.Error())
+		return 1
+	}
+	configData.RegistersCsv = ""
+	configData.Include = nil
+	configData.Templates = nil
+	configData.Devices = nil
+	if configData.Auth != nil {
+		redacted := configData.Auth.Redacted()
+		configData.Auth = &redacted
+	}
+	effective, err := types.EncodeConfig(configData, *formatPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_, _ = os.Stdout.Write(effective)
+
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
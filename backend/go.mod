@@ -3,8 +3,11 @@ module github.com/dshargool/go-mbslave-api.git
 go 1.22.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/simonvetter/modbus v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/goburrow/serial v0.1.0 // indirect
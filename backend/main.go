@@ -6,6 +6,8 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/dshargool/go-mbslave-api.git/pkg/handlers"
 	"github.com/dshargool/go-mbslave-api.git/pkg/types"
@@ -14,23 +16,26 @@ import (
 var config = types.Configuration{}
 
 func main() {
-	configPtr := flag.String("config", "config.json", "Config File Path")
-	dbPtr := flag.String("database", "", "Database File Path")
+	// Subcommands are handled before the server's own flags are parsed
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
+	configPtr, overrides := configFlags(flag.CommandLine)
+	restorePtr := flag.String("restore", "", "Database snapshot to restore before starting")
 	flag.Parse()
 
 	config_path := *configPtr
 	slog.Info("Reading configuration file: " + config_path)
 
-	config, err := config.ReadConfig(config_path)
+	config, err := config.ReadConfig(config_path, overrides()...)
 	if err != nil {
 		log.Fatal("Error reading config ", err)
 	}
 
-	db_path := *dbPtr
-
-	if db_path == "" {
-		db_path = config.DBPath
-	}
+	db_path := config.DBPath
 	slog.Info("Opening database file: " + db_path)
 
 	myDb := types.SqlDb{}
@@ -44,15 +49,56 @@ func main() {
 	if err != nil {
 		os.Exit(1)
 	}
-	myDb.UpdateTableTags(config.Registers)
+	startup := types.WriteOrigin{Source: types.SourceConfig}
+	if *restorePtr != "" {
+		err = types.ValidateSnapshot(*restorePtr)
+		if err != nil {
+			log.Fatal("Error restoring database snapshot ", err)
+		}
+	}
+	// Tag changes made while stopped are audited against the definitions the
+	// database was last configured with
+	var reconciled types.ReconcileReport
+	err = myDb.Transaction(func(tx *types.SqlDb) error {
+		if *restorePtr != "" {
+			if _, err := tx.Restore(*restorePtr, startup); err != nil {
+				return fmt.Errorf("restoring database snapshot: %w", err)
+			}
+		}
+		previous, err := tx.AuditedRegisters()
+		if err != nil {
+			return fmt.Errorf("reading audited tags: %w", err)
+		}
+		reconciled, err = tx.ApplyRegisters(previous, config.Registers, nil, config.OrphanPolicy, startup)
+		return err
+	})
+	if err != nil {
+		log.Fatal("Error applying configuration to database: ", err)
+	}
+	slog.Info("Reconciled database with configuration", "report", reconciled)
 
 	slog.Info("Starting modbus TCP slave")
 
 	slog.Info("Starting handler")
 	handler := handlers.New(config, &myDb)
+	handler.ConfigPath = config_path
+	handler.ConfigOverrides = overrides()
 	handler.MbSlave = handler.MbInit(config.ModbusPort)
 	handler.MbStart()
 	defer handler.MbStop()
+
+	// Reload the register map on SIGHUP without dropping Modbus connections
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			slog.Info("Received SIGHUP, reloading configuration")
+			if _, err := handler.Reload(types.WriteOrigin{Source: types.SourceConfig}); err != nil {
+				slog.Error("Unable to reload configuration", "error", err)
+			}
+		}
+	}()
+
 	handler.HandleRequests(config.ApiPort)
 
 	fmt.Println("End")
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// overrideFlag records a configuration override each time its flag is set
+type overrideFlag struct {
+	field     types.OverrideField
+	overrides *[]types.ConfigOverride
+}
+
+func (f *overrideFlag) String() string {
+	return ""
+}
+
+func (f *overrideFlag) Set(value string) error {
+	*f.overrides = append(*f.overrides, types.ConfigOverride{Field: f.field.Name, Value: value, Source: "-" + f.field.Name})
+	return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool {
+	return f.field.IsBool
+}
+
+// configFlags adds -config and a flag for every overridable configuration field.
+// The returned function gives the environment overrides followed by the flag
+// overrides so that flags take precedence.
+func configFlags(flags *flag.FlagSet) (*string, func() []types.ConfigOverride) {
+	configPath := "config.json"
+	if path, found := os.LookupEnv(types.EnvPrefix + "CONFIG"); found {
+		configPath = path
+	}
+	configPtr := flags.String("config", configPath, "Config File Path (env "+types.EnvPrefix+"CONFIG)")
+
+	var flagOverrides []types.ConfigOverride
+	for _, field := range types.OverrideFields() {
+		flags.Var(&overrideFlag{field, &flagOverrides}, field.Name, "Override "+field.Name+" (env "+field.Env+")")
+		// -database predates the overrides and is kept as another name for -db
+		if field.Name == "db" {
+			flags.Var(&overrideFlag{field, &flagOverrides}, "database", "Database File Path; same as -db")
+		}
+	}
+	return configPtr, func() []types.ConfigOverride {
+		return append(types.EnvOverrides(os.LookupEnv), flagOverrides...)
+	}
+}
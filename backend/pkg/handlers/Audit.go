@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// Entries returned by GET /audit without a limit
+const defaultAuditLimit = 100
+
+// Timestamps in the audit log, which are in UTC
+const auditTimeFormat = "2006-01-02 15:04:05"
+
+// GetAudit lists the audit log newest first.  It can be filtered by ?action=,
+// ?source=, ?actor=, a ?tag= glob, ?address= and an inclusive RFC 3339 ?since=
+// and ?until=, and paged with ?limit= (100 by default) and ?page=.
+// X-Total-Count is the number of matching entries.
+func (h Handler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	query, err := auditQuery(r.URL.Query(), defaultAuditLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: err.Error()})
+		return
+	}
+	entries, total, err := h.db.QueryAudit(query)
+	if err != nil {
+		slog.Error("Unable to read audit log", "error", err)
+		internalError(w, ApiError{Message: "unable to read audit log"})
+		return
+	}
+	w.Header().Add("X-Total-Count", strconv.Itoa(total))
+	writeJson(w, http.StatusOK, entries)
+}
+
+// GetAuditCsv exports the audit log as CSV with the filters of GetAudit,
+// every matching entry unless limited
+func (h Handler) GetAuditCsv(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	query, err := auditQuery(r.URL.Query(), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: err.Error()})
+		return
+	}
+	entries, _, err := h.db.QueryAudit(query)
+	if err != nil {
+		slog.Error("Unable to read audit log", "error", err)
+		internalError(w, ApiError{Message: "unable to read audit log"})
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/csv")
+	w.Header().Add("Content-Disposition", "attachment; filename=\"audit.csv\"")
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"id", "timestamp", "action", "tag", "address", "old_value", "new_value", "before", "after",
+		"source", "actor", "client_addr", "request_id"})
+	for _, entry := range entries {
+		_ = writer.Write([]string{strconv.FormatInt(entry.Id, 10), entry.Timestamp, entry.Action, entry.Tag, entry.Address,
+			csvValue(entry.OldValue), csvValue(entry.NewValue), csvRegister(entry.Before), csvRegister(entry.After),
+			entry.Source, entry.Actor, entry.ClientAddr, entry.RequestId})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		slog.Error("Unable to write audit csv", "err", err.Error())
+	}
+}
+
+func csvValue(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+// csvRegister writes a tag definition as JSON in a single cell
+func csvRegister(register *types.ModbusTag) string {
+	if register == nil {
+		return ""
+	}
+	encoded, _ := json.Marshal(register)
+	return string(encoded)
+}
+
+// auditQuery reads the filters and page of GetAudit
+func auditQuery(values url.Values, defaultLimit int) (query types.AuditQuery, err error) {
+	query.Actions = values["action"]
+	for _, action := range query.Actions {
+		if !slices.Contains(types.AuditActions(), action) {
+			return query, errors.New("action must be one of " + strings.Join(types.AuditActions(), ", "))
+		}
+	}
+	query.Source = values.Get("source")
+	query.Actor = values.Get("actor")
+	query.Address = values.Get("address")
+	query.Tag = values.Get("tag")
+	if _, err := path.Match(query.Tag, ""); err != nil {
+		return query, errors.New("invalid pattern " + strconv.Quote(query.Tag))
+	}
+	for name, bound := range map[string]*string{"since": &query.Since, "until": &query.Until} {
+		if !values.Has(name) {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339, values.Get(name))
+		if err != nil {
+			return query, errors.New(name + " must be an RFC 3339 time such as 2024-01-02T15:04:05Z")
+		}
+		*bound = timestamp.UTC().Format(auditTimeFormat)
+	}
+
+	query.Limit = defaultLimit
+	if values.Has("limit") {
+		query.Limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil || query.Limit < 1 {
+			return query, errors.New("limit must be a positive number")
+		}
+	}
+	if values.Has("page") {
+		page, err := strconv.Atoi(values.Get("page"))
+		if err != nil || page < 1 {
+			return query, errors.New("page must be a positive number")
+		} else if query.Limit == 0 {
+			return query, errors.New("page needs a limit")
+		}
+		query.Offset = (page - 1) * query.Limit
+	}
+	return query, nil
+}
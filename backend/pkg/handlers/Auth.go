@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// tokenKey holds the authenticated types.ApiToken in a request's context
+type tokenKey struct{}
+
+// Auth returns the current authentication configuration
+func (h Handler) Auth() types.AuthConfig {
+	if h.auth == nil {
+		return types.AuthConfig{}
+	}
+	return *h.auth.Load()
+}
+
+// Routes taking ?access_token= for EventSource and WebSocket clients in
+// browsers, which can't set headers.  Elsewhere a token in the URL would only
+// end up in logs and browser history.
+var queryTokenRoutes = map[string]bool{"/events": true, "/ws": true}
+
+// requestToken reads the token from an Authorization bearer, X-API-Key or, on
+// the queryTokenRoutes, ?access_token=
+func requestToken(r *http.Request, pattern string) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if token := r.Header.Get("X-API-Key"); token != "" {
+		return token
+	}
+	if queryTokenRoutes[pattern] {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// authorize refuses requests without a token allowed to use the route's
+// operation once tokens are configured, and passes the token on in the
+// request's context for the handlers checking each tag's group
+func (h Handler) authorize(mux *http.ServeMux, routes []route) http.Handler {
+	operations := make(map[string]map[string]operation)
+	for _, route := range routes {
+		operations[route.pattern] = route.operations
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := h.Auth()
+		_, pattern := mux.Handler(r)
+		if !auth.Enabled() || (pattern == "/healthcheck" && auth.PublicHealthcheck) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		token, found := auth.Authenticate(requestToken(r, pattern))
+		if !found {
+			slog.Warn("Unauthenticated request", "client", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mbslave-api"`)
+			writeError(w, http.StatusUnauthorized, ApiError{Code: ErrorUnauthorized, Message: "a valid token is required"})
+			return
+		}
+		// Unknown methods are left to the handler to refuse
+		if op, found := operations[pattern][strings.ToLower(r.Method)]; found {
+			role := token.HighestRole()
+			if op.global {
+				role = token.RoleFor("")
+			}
+			if need := cmp.Or(op.role, types.RoleViewer); !types.RoleAllows(role, need) {
+				slog.Warn("Forbidden request", "token", token.Name, "method", r.Method, "path", r.URL.Path)
+				forbidden(w, ApiError{Message: "the " + need + " role is required"})
+				return
+			}
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	})
+}
+
+// actor names the request's token, or is empty without tokens
+func actor(r *http.Request) string {
+	token, _ := r.Context().Value(tokenKey{}).(types.ApiToken)
+	return token.Name
+}
+
+// permitted reports whether the request may use role on the tags in the group
+// at path.  Everything is permitted without tokens.
+func (h Handler) permitted(r *http.Request, path string, role string) bool {
+	if !h.Auth().Enabled() {
+		return true
+	}
+	token, found := r.Context().Value(tokenKey{}).(types.ApiToken)
+	return found && types.RoleAllows(token.RoleFor(path), role)
+}
+
+// permittedTag is permitted for a configured tag's group
+func (h Handler) permittedTag(r *http.Request, tag string, role string) bool {
+	return h.permitted(r, h.registers.Get()[types.InstrumentTag(tag)].Path, role)
+}
+
+// permittedAddress is permitted for the group of the data point at address
+func (h Handler) permittedAddress(r *http.Request, address string, role string) bool {
+	if !h.Auth().Enabled() {
+		return true
+	}
+	row, err := h.db.GetRowByAddress(address)
+	if err != nil {
+		// Unknown addresses are left to the handler to refuse
+		return h.permitted(r, "", role)
+	}
+	return h.permitted(r, row.Path, role)
+}
+
+// visibleRegisters returns the registers the request may view
+func (h Handler) visibleRegisters(r *http.Request) map[types.InstrumentTag]types.ModbusTag {
+	current := h.registers.Get()
+	visible := make(map[types.InstrumentTag]types.ModbusTag, len(current))
+	for tag, register := range current {
+		if h.permitted(r, register.Path, types.RoleViewer) {
+			visible[tag] = register
+		}
+	}
+	return visible
+}
+
+func forbidden(w http.ResponseWriter, apiErr ApiError) {
+	apiErr.Code = ErrorForbidden
+	writeError(w, http.StatusForbidden, apiErr)
+}
+
+// cors answers browsers calling the API from its own or the allowed origins,
+// including preflight requests which never carry a token.  Without allowed
+// origins or tokens any origin may still make reads that need no preflight.
+// Anything else from another origin is refused, as browsers send forms and
+// other simple requests without asking first.
+func (h Handler) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := h.Auth()
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && (sameOrigin(r, origin) || auth.AllowsOrigin(origin))
+		w.Header().Add("Vary", "Origin")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Total-Count, X-Request-ID")
+		} else if origin != "" && auth.AllowsAnyReader() && (r.Method == "GET" || r.Method == "HEAD") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Total-Count, X-Request-ID")
+		}
+		if origin != "" && !allowed && r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			slog.Warn("Refusing request from another origin", "origin", origin, "method", r.Method, "path", r.URL.Path)
+			forbidden(w, ApiError{Message: "origin " + strconv.Quote(origin) + " is not allowed"})
+			return
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, Last-Event-ID, X-API-Key, X-Request-ID")
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin accepts WebSockets from clients other than browsers, the API's
+// own origin and the configured allowed origins.  Browsers don't apply CORS to
+// WebSockets, so without this any page could write values over one.
+func (h Handler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || sameOrigin(r, origin) || h.Auth().AllowsOrigin(origin)
+}
+
+// sameOrigin reports whether origin is the API's own
+func sameOrigin(r *http.Request, origin string) bool {
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
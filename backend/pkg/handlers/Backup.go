@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// Largest snapshot we will accept on a restore request
+const maxSnapshotSize = 512 << 20
+
+func (h Handler) Backup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+
+	// VACUUM INTO refuses to overwrite so we only reserve a directory for the snapshot
+	dir, err := os.MkdirTemp("", "mbslave-backup")
+	if err != nil {
+		slog.Error("Unable to create backup directory", "error", err)
+		internalError(w, ApiError{Message: "unable to create backup"})
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	snapshotPath := filepath.Join(dir, "snapshot.db")
+	err = h.db.Backup(snapshotPath)
+	if err != nil {
+		slog.Error("Unable to back up database", "error", err)
+		internalError(w, ApiError{Message: "unable to back up database"})
+		return
+	}
+	snapshot, err := os.Open(snapshotPath)
+	if err != nil {
+		slog.Error("Unable to open database backup", "error", err)
+		internalError(w, ApiError{Message: "unable to open database backup"})
+		return
+	}
+	defer snapshot.Close()
+	info, err := snapshot.Stat()
+	if err != nil {
+		internalError(w, ApiError{Message: "unable to open database backup"})
+		return
+	}
+
+	fileName := "mbslave-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	w.Header().Add("Content-Type", "application/vnd.sqlite3")
+	w.Header().Add("Content-Disposition", "attachment; filename=\""+fileName+"\"")
+	w.Header().Add("Content-Length", strconv.FormatInt(info.Size(), 10))
+	_, err = io.Copy(w, snapshot)
+	if err != nil {
+		slog.Error("Unable to stream database backup", "error", err)
+		return
+	}
+	slog.Info("Database backup sent", "size", info.Size())
+}
+
+func (h Handler) Restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+
+	upload, err := os.CreateTemp("", "mbslave-restore-*.db")
+	if err != nil {
+		slog.Error("Unable to create restore file", "error", err)
+		internalError(w, ApiError{Message: "unable to store snapshot"})
+		return
+	}
+	defer os.Remove(upload.Name())
+
+	_, err = io.Copy(upload, http.MaxBytesReader(w, r.Body, maxSnapshotSize))
+	upload.Close()
+	if err != nil {
+		slog.Error("Unable to read restore snapshot", "error", err)
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "unable to read snapshot: " + err.Error()})
+		return
+	}
+
+	err = types.ValidateSnapshot(upload.Name())
+	if err != nil {
+		slog.Error("Invalid restore snapshot", "error", err)
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "unable to restore snapshot: " + err.Error()})
+		return
+	}
+
+	// The register map can't change between restoring and reapplying it
+	h.registers.update.Lock()
+	defer h.registers.update.Unlock()
+	registers := h.registers.Get()
+	origin := apiOrigin(w, r)
+	var restored int64
+	err = h.db.Transaction(func(tx *types.SqlDb) (err error) {
+		restored, err = tx.Restore(upload.Name(), origin)
+		if err != nil {
+			return err
+		}
+		// The configured register map always wins over whatever the snapshot described
+		_, err = tx.ApplyRegisters(registers, registers, nil, h.registers.orphanPolicy, origin)
+		return err
+	})
+	if err != nil {
+		slog.Error("Unable to restore snapshot", "error", err)
+		internalError(w, ApiError{Message: "unable to restore snapshot"})
+		return
+	}
+
+	slog.Info("Database restored from snapshot", "rows", restored)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// Largest number of items accepted in a single batch
+const maxBatchItems = 1000
+
+// BatchItem reads a tag or address, or writes it when Value is given
+type BatchItem struct {
+	Tag     string   `json:"tag,omitempty"`
+	Address string   `json:"address,omitempty"`
+	Value   *float64 `json:"value,omitempty"`
+}
+
+// BatchRequest is the body of POST /batch.  An atomic batch applies every
+// write or none of them.
+type BatchRequest struct {
+	Atomic bool        `json:"atomic"`
+	Items  []BatchItem `json:"items"`
+}
+
+// BatchResult is the outcome of one item, in the same order as the request
+type BatchResult struct {
+	Tag     string                `json:"tag,omitempty"`
+	Address string                `json:"address,omitempty"`
+	Status  int                   `json:"status"`
+	Result  *types.ModbusResponse `json:"result,omitempty"`
+	Error   *ApiError             `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// errBatchFailed rolls back an atomic batch
+var errBatchFailed = errors.New("batch item failed")
+
+func (h Handler) Batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+
+	if err := requireJson(r); err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, ApiError{Code: ErrorInvalidRequest, Message: err.Error()})
+		return
+	}
+	var batch BatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&batch)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "invalid batch: " + err.Error()})
+		return
+	} else if len(batch.Items) > maxBatchItems {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "batches are limited to 1000 items"})
+		return
+	}
+	origin := apiOrigin(w, r)
+	permit := func(path string, role string) bool { return h.permitted(r, path, role) }
+
+	status := http.StatusOK
+	results := make([]BatchResult, 0, len(batch.Items))
+	if !batch.Atomic {
+		for _, item := range batch.Items {
+			results = append(results, batchItem(h.db, item, origin, permit))
+		}
+	} else {
+		err = h.db.Transaction(func(tx *types.SqlDb) error {
+			for _, item := range batch.Items {
+				result := batchItem(tx, item, origin, permit)
+				results = append(results, result)
+				if result.Error != nil {
+					status = http.StatusUnprocessableEntity
+					return errBatchFailed
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errBatchFailed) {
+			slog.Error("Unable to apply batch", "error", err)
+			internalError(w, ApiError{Message: "unable to apply batch"})
+			return
+		}
+		if err != nil {
+			// Nothing was applied so the items that succeeded are reported as such
+			for i := range batch.Items {
+				if i >= len(results) {
+					results = append(results, BatchResult{Tag: batch.Items[i].Tag, Address: batch.Items[i].Address})
+				} else if results[i].Error != nil {
+					continue
+				}
+				results[i].Status = http.StatusFailedDependency
+				results[i].Result = nil
+				results[i].Error = &ApiError{Code: ErrorNotApplied, Message: "not applied as another item failed"}
+			}
+		}
+	}
+
+	slog.Info("Batch request", "items", len(batch.Items), "atomic", batch.Atomic, "status", status)
+	writeJson(w, status, BatchResponse{Results: results})
+}
+
+// batchItem writes the item if it has a value then reads it back.  permit
+// reports whether the caller has a role for a group.
+func batchItem(db *types.SqlDb, item BatchItem, origin types.WriteOrigin, permit func(path string, role string) bool) BatchResult {
+	result := BatchResult{Tag: item.Tag, Address: item.Address}
+	fail := func(status int, code string, message string) BatchResult {
+		result.Status = status
+		result.Error = &ApiError{Code: code, Message: message, Tag: item.Tag, Address: item.Address}
+		return result
+	}
+	if (item.Tag == "") == (item.Address == "") {
+		return fail(http.StatusBadRequest, ErrorInvalidRequest, "give either a tag or an address")
+	}
+
+	get, set, key := db.GetRowByTag, db.SetTagValue, item.Tag
+	if item.Tag == "" {
+		get, set, key = db.GetRowByAddress, db.SetAddressValue, item.Address
+	}
+	// The row is read first for the group its permissions come from
+	row, err := get(key)
+	need := types.RoleViewer
+	if item.Value != nil {
+		need = types.RoleOperator
+	}
+	if err == nil && !permit(row.Path, need) {
+		return fail(http.StatusForbidden, ErrorForbidden, "the "+need+" role is required")
+	}
+	if err == nil && item.Value != nil {
+		err = set(key, *item.Value, origin)
+		if err == nil {
+			row, err = get(key)
+		}
+	}
+	if status, apiErr, refused := writeRefused(err); refused {
+		return fail(status, apiErr.Code, apiErr.Message)
+	} else if err == sql.ErrNoRows && item.Tag != "" {
+		return fail(http.StatusNotFound, ErrorNotFound, "tag not found")
+	} else if err == sql.ErrNoRows {
+		return fail(http.StatusNotFound, ErrorNotFound, "register not found")
+	} else if err != nil {
+		slog.Error("Unable to apply batch item", "tag", item.Tag, "address", item.Address, "error", err)
+		return fail(http.StatusInternalServerError, ErrorInternal, "unable to read or write value")
+	}
+	result.Status = http.StatusOK
+	result.Result = &row
+	return result
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// errInvalidIfMatch refuses a write whose If-Match can't be understood
+var errInvalidIfMatch = errors.New("invalid If-Match")
+
+// etag is the entity tag of a data point, which changes with every write to
+// its value
+func etag(row types.ModbusResponse) string {
+	return `"` + strconv.FormatInt(row.Version, 10) + `"`
+}
+
+// ifMatch reads the versions accepted by an If-Match header.  unconditional
+// is true without the header or for "*".
+func ifMatch(r *http.Request) (versions []int64, unconditional bool, err error) {
+	header := r.Header.Values("If-Match")
+	if len(header) == 0 {
+		return nil, true, nil
+	}
+	for _, value := range strings.Split(strings.Join(header, ","), ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" {
+			return nil, true, nil
+		}
+		// Weak tags never match as If-Match uses the strong comparison
+		if strings.HasPrefix(value, "W/") {
+			continue
+		}
+		version, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+		if err != nil || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+			return nil, false, fmt.Errorf("%w: %q is not an entity tag from this API", errInvalidIfMatch, value)
+		}
+		versions = append(versions, version)
+	}
+	return versions, false, nil
+}
+
+// setValue writes a data point's value by "tag" or "address", only if its
+// version still matches If-Match when the request has one
+func (h Handler) setValue(r *http.Request, column string, key string, value float64, origin types.WriteOrigin) error {
+	versions, unconditional, err := ifMatch(r)
+	if err != nil {
+		return err
+	}
+	set, setIfVersion := h.db.SetTagValue, h.db.SetTagValueIfVersion
+	get := h.db.GetRowByTag
+	if column == "address" {
+		set, setIfVersion = h.db.SetAddressValue, h.db.SetAddressValueIfVersion
+		get = h.db.GetRowByAddress
+	}
+	if unconditional {
+		return set(key, value, origin)
+	}
+	current, err := get(key)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(versions, current.Version) {
+		return fmt.Errorf("%w: %s %s is at %s", types.ErrVersionMismatch, column, key, etag(current))
+	}
+	return setIfVersion(key, value, current.Version, origin)
+}
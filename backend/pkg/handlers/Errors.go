@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// Error codes returned in ApiError.Code
+const (
+	ErrorNotFound         = "not_found"
+	ErrorInvalidValue     = "invalid_value"
+	ErrorInvalidRequest   = "invalid_request"
+	ErrorMethodNotAllowed = "method_not_allowed"
+	ErrorConflict         = "conflict"
+	ErrorUnauthorized     = "unauthorized"
+	ErrorForbidden        = "forbidden"
+	ErrorReadOnly         = "read_only"
+	ErrorPrecondition     = "precondition_failed"
+	ErrorInvalidConfig    = "invalid_configuration"
+	ErrorUnavailable      = "unavailable"
+	ErrorInternal         = "internal"
+	// A batch item that wasn't applied because another item of an atomic batch failed
+	ErrorNotApplied = "not_applied"
+)
+
+// ApiError describes why a request failed.  Tag or Address name the data point
+// the request was for when there is one.
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Tag     string `json:"tag,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error ApiError `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, apiErr ApiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(ErrorResponse{Error: apiErr})
+	if err != nil {
+		slog.Error("Unable to write error response", "error", err)
+	}
+}
+
+// writeRefused describes a write refused by a data point's access mode, limits
+// or version, if err is one
+func writeRefused(err error) (status int, apiErr ApiError, refused bool) {
+	switch {
+	case errors.Is(err, types.ErrVersionMismatch):
+		return http.StatusPreconditionFailed, ApiError{Code: ErrorPrecondition, Message: err.Error()}, true
+	case errors.Is(err, errInvalidIfMatch):
+		return http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: err.Error()}, true
+	case errors.Is(err, types.ErrReadOnly):
+		return http.StatusForbidden, ApiError{Code: ErrorReadOnly, Message: err.Error()}, true
+	case errors.Is(err, types.ErrOutOfRange):
+		return http.StatusBadRequest, ApiError{Code: ErrorInvalidValue, Message: err.Error()}, true
+	}
+	return 0, ApiError{}, false
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, ApiError{
+		Code:    ErrorMethodNotAllowed,
+		Message: r.Method + " is not allowed; use " + allow,
+	})
+}
+
+func internalError(w http.ResponseWriter, apiErr ApiError) {
+	apiErr.Code = ErrorInternal
+	writeError(w, http.StatusInternalServerError, apiErr)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "no route for " + r.URL.Path})
+}
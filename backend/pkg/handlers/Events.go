@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// Interval between comments sent to keep idle event streams open through proxies
+const eventKeepAlive = 15 * time.Second
+
+// Changes an event stream may fall behind by before it is dropped
+const eventBuffer = 256
+
+// Events streams value changes as Server-Sent Events.  Each ?tag= is a glob
+// such as "Pump*"; without any every change is sent.  A reconnecting client's
+// Last-Event-ID is used to send the changes it missed, or a reset event if they
+// are no longer retained.  Only changes to tags the request may view are sent.
+func (h Handler) Events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	patterns := r.URL.Query()["tag"]
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "invalid tag pattern " + strconv.Quote(pattern), Tag: pattern})
+			return
+		}
+	}
+
+	var sub *types.Subscription
+	var missed []types.ValueChange
+	complete := true
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventId != "" {
+		lastId, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "invalid Last-Event-ID " + strconv.Quote(lastEventId)})
+			return
+		}
+		sub, missed, complete = h.db.Changes.SubscribeSince(lastId, eventBuffer)
+	} else {
+		sub = h.db.Changes.Subscribe(eventBuffer)
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	stream := http.NewResponseController(w)
+	slog.Info("Event stream opened", "client", r.RemoteAddr, "tags", patterns, "last_event_id", lastEventId)
+
+	if !complete {
+		// The client has to reload everything as some changes are gone
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, change := range missed {
+		if h.permittedTag(r, change.Tag, types.RoleViewer) {
+			writeEvent(w, patterns, change)
+		}
+	}
+	_ = stream.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.Info("Event stream closed", "client", r.RemoteAddr)
+			return
+		case change, open := <-sub.C:
+			if !open {
+				// Fell behind; the client reconnects and catches up with Last-Event-ID
+				return
+			}
+			if h.permittedTag(r, change.Tag, types.RoleViewer) {
+				writeEvent(w, patterns, change)
+			}
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keep-alive\n\n")
+		}
+		if err := stream.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, patterns []string, change types.ValueChange) {
+	if !matchTag(patterns, change.Tag) {
+		return
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		slog.Error("Unable to encode change", "error", err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", change.Id, data)
+}
+
+// matchTag reports whether a tag matches any of the glob patterns, or there are none
+func matchTag(patterns []string, tag string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+	return false
+}
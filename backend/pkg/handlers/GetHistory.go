@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+const defaultHistoryLimit = 100
+
+func (h Handler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	tag := strings.TrimPrefix(r.URL.Path, "/history/")
+
+	limit := defaultHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "limit " + strconv.Quote(value) + " is not a positive number", Tag: tag})
+			return
+		}
+		limit = min(limit, types.MaxHistoryPerAddress)
+	}
+
+	if !h.permittedTag(r, tag, types.RoleViewer) {
+		forbidden(w, ApiError{Message: "not permitted to read tag", Tag: tag})
+		return
+	}
+	row, err := h.db.GetRowByTag(tag)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "tag not found", Tag: tag})
+		return
+	} else if err != nil {
+		slog.Warn("Database error", "error", err)
+		internalError(w, ApiError{Message: "unable to read tag", Tag: tag})
+		return
+	}
+	// The history holds every value a write-only tag has been given
+	if row.Access == types.AccessWriteOnly {
+		forbidden(w, ApiError{Message: "tag is write-only", Tag: tag})
+		return
+	}
+
+	history, err := h.db.GetHistoryByTag(tag, limit)
+	if err != nil {
+		slog.Warn("Could not get tag history", "tag", tag, "error", err)
+		internalError(w, ApiError{Message: "unable to read tag history", Tag: tag})
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(history)
+	if err != nil {
+		slog.Error("Unable to write response", "error", err)
+		return
+	}
+}
@@ -1,53 +1,169 @@
 package handlers
 
 import (
+	"cmp"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/dshargool/go-mbslave-api.git/pkg/types"
 )
 
+// GetRegisters lists the configured data points in address order.  They can
+// be filtered by ?tag= and ?description= globs, ?datatype=, ?group= and an
+// inclusive ?min_address= and ?max_address=, sorted with ?sort= and paged with
+// ?limit= and ?page=.  X-Total-Count is the number of matching data points.
+// Tags in groups the request may not view are left out.
 func (h Handler) GetRegisters(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		var registers []types.ModbusResponse
-		for addr := range h.registers {
-			val, err := h.db.GetRowByTag(string(addr))
-			if err != nil {
-				slog.Error("Unable to get register", "addr", string(addr), "err", err.Error())
-				reg := h.registers[addr]
-				empty_val := types.ModbusResponse{
-					Tag:         string(reg.Tag),
-					Description: reg.Description,
-					Address:     reg.Address,
-					DataType:    reg.DataType,
-					Value:       -1.0,
-					LastUpdate:  "",
-				}
-				registers = append(registers, empty_val)
-			} else {
-				registers = append(registers, val)
-			}
+		query, err := registerQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: err.Error()})
+			return
+		}
+		current := h.visibleRegisters(r)
+		query.Tags = make([]string, 0, len(current))
+		for tag := range current {
+			query.Tags = append(query.Tags, string(tag))
+		}
+		registers, total, err := h.db.QueryRows(query)
+		if err != nil {
+			slog.Error("Unable to get registers", "err", err.Error())
+			internalError(w, ApiError{Message: "unable to read registers"})
+			return
 		}
 		jRegister, err := json.Marshal(registers)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			internalError(w, ApiError{Message: "unable to encode registers"})
 			return
 		}
 		w.Header().Add("Content-Type", "application/json")
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("X-Total-Count", strconv.Itoa(total))
 		_, err = w.Write(jRegister)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("Unable to write response", "error", err)
 			return
 		}
+	default:
+		methodNotAllowed(w, r, "GET")
 	}
 }
 
+// registerQuery reads the filters, sort and page of GetRegisters
+func registerQuery(values url.Values) (query types.RegisterQuery, err error) {
+	query.TagPatterns = values["tag"]
+	query.Description = values.Get("description")
+	for _, pattern := range append(values["tag"], query.Description) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return query, errors.New("invalid pattern " + strconv.Quote(pattern))
+		}
+	}
+	query.DataTypes = values["datatype"]
+	query.Group = strings.Trim(values.Get("group"), "/")
+	if !types.ValidGroupPath(query.Group) {
+		return query, errors.New("invalid group path " + strconv.Quote(query.Group))
+	}
+
+	for name, bound := range map[string]**int{"min_address": &query.MinAddress, "max_address": &query.MaxAddress} {
+		if !values.Has(name) {
+			continue
+		}
+		address, err := strconv.Atoi(values.Get(name))
+		if err != nil {
+			return query, errors.New(name + " must be a register number")
+		}
+		*bound = &address
+	}
+
+	query.Sort = values.Get("sort")
+	if !slices.Contains(types.RegisterSortKeys(), strings.TrimPrefix(query.Sort, "-")) && query.Sort != "" {
+		return query, errors.New("sort must be one of " + strings.Join(types.RegisterSortKeys(), ", ") + ", prefixed with - for descending order")
+	}
+
+	if values.Has("limit") {
+		query.Limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil || query.Limit < 1 {
+			return query, errors.New("limit must be a positive number")
+		}
+	}
+	if values.Has("page") {
+		page, err := strconv.Atoi(values.Get("page"))
+		if err != nil || page < 1 {
+			return query, errors.New("page must be a positive number")
+		} else if query.Limit == 0 {
+			return query, errors.New("page needs a limit")
+		}
+		query.Offset = (page - 1) * query.Limit
+	}
+	return query, nil
+}
+
+// GetRegistersCsv exports the register map and current values as CSV in
+// address order, in the same layout accepted by registers_csv.  Only the tags
+// the request may view are exported.
+func (h Handler) GetRegistersCsv(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+
+	current := h.visibleRegisters(r)
+	registers := make([]types.ModbusTag, 0, len(current))
+	for _, register := range current {
+		registers = append(registers, register)
+	}
+	slices.SortFunc(registers, compareAddress)
+
+	w.Header().Add("Content-Type", "text/csv")
+	w.Header().Add("Content-Disposition", "attachment; filename=\"registers.csv\"")
+	writer := csv.NewWriter(w)
+	_ = writer.Write(types.RegisterCsvHeader())
+	for _, register := range registers {
+		current, err := h.db.GetRowByTag(register.Tag)
+		if err != nil {
+			slog.Error("Unable to get register", "tag", register.Tag, "err", err.Error())
+			current = types.ModbusResponse{Quality: types.QualityBad}
+		}
+		record, err := types.RegisterCsvRecord(register, current)
+		if err != nil {
+			slog.Error("Unable to format register", "tag", register.Tag, "err", err.Error())
+			continue
+		}
+		_ = writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		slog.Error("Unable to write registers csv", "err", err.Error())
+	}
+}
+
+// compareAddress orders registers by holding register then bit, unparsable
+// addresses last
+func compareAddress(a types.ModbusTag, b types.ModbusTag) int {
+	aRegister, aBit, aErr := types.ParseAddress(a.Address)
+	bRegister, bBit, bErr := types.ParseAddress(b.Address)
+	if aErr != nil || bErr != nil {
+		return cmp.Or(cmp.Compare(boolInt(aErr != nil), boolInt(bErr != nil)), strings.Compare(a.Address, b.Address))
+	}
+	return cmp.Or(cmp.Compare(aRegister, bRegister), cmp.Compare(aBit, bBit), strings.Compare(a.Tag, b.Tag))
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func (h Handler) GetRegister(w http.ResponseWriter, r *http.Request) {
 	request := r.URL.Path
 	address := strings.TrimPrefix(request, "/register/")
@@ -59,50 +175,56 @@ func (h Handler) GetRegister(w http.ResponseWriter, r *http.Request) {
 		response, err = h.db.GetRowByAddress(address)
 		if err == sql.ErrNoRows {
 			slog.Warn("Could not get row by address; row not found", "error", err, "address", address)
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "register not found", Address: address})
 			return
 		} else if err != nil {
 			slog.Warn("Could not get row by address", "err", err, "address", address)
-			w.WriteHeader(http.StatusInternalServerError)
+			internalError(w, ApiError{Message: "unable to read register", Address: address})
 			return
 		}
-		slog.Info("GET request for /register/<ADDRESS>", "address", address, "response", response)
-	case "PUT":
-		query := r.URL.Query()
-		value := query.Get("value")
-
-		if value == "" {
-			value = query.Get("val")
-		}
-		if value == "" {
-			w.WriteHeader(http.StatusBadRequest)
+		if !h.permitted(r, response.Path, types.RoleViewer) {
+			forbidden(w, ApiError{Message: "not permitted to read register", Address: address})
 			return
 		}
-		fValue, err := strconv.ParseFloat(value, 64)
+		slog.Info("GET request for /register/<ADDRESS>", "address", address, "response", response)
+	case "PUT":
+		fValue, err := requestValue(r)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, bodyStatus(err), ApiError{Code: ErrorInvalidValue, Message: err.Error(), Address: address})
 			return
-
 		}
 		slog.Info("PUT request for /register/<ADDRESS>", "address", address, "value", fValue)
-		err = h.db.SetAddressValue(address, fValue)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if !h.permittedAddress(r, address, types.RoleOperator) {
+			forbidden(w, ApiError{Message: "not permitted to write register", Address: address})
+			return
+		}
+		err = h.setValue(r, "address", address, fValue, apiOrigin(w, r))
+		if status, apiErr, refused := writeRefused(err); refused {
+			apiErr.Address = address
+			writeError(w, status, apiErr)
+			return
+		} else if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "register not found", Address: address})
+			return
+		} else if err != nil {
+			internalError(w, ApiError{Message: "unable to set register value", Address: address})
 			return
 		}
 		response, err = h.db.GetRowByAddress(address)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			internalError(w, ApiError{Message: "unable to read register", Address: address})
 			return
 		}
 
 	default:
-		w.WriteHeader(http.StatusBadRequest)
+		methodNotAllowed(w, r, "GET, PUT")
+		return
 	}
 	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(response))
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("Unable to write response", "error", err)
 		return
 	}
 }
@@ -3,64 +3,195 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
 )
 
 func (h Handler) GetTag(w http.ResponseWriter, r *http.Request) {
 	request := r.URL.Path
 	tag := strings.TrimPrefix(request, "/tag/")
-	query := r.URL.Query()
 
 	switch r.Method {
 	case "GET":
-		w.Header().Add("Content-Type", "application/json")
+		if !h.permittedTag(r, tag, types.RoleViewer) {
+			forbidden(w, ApiError{Message: "not permitted to read tag", Tag: tag})
+			return
+		}
+		if r.URL.Query().Has("wait") {
+			h.waitForTag(w, r, tag)
+			return
+		}
 		response, err := h.db.GetRowByTag(tag)
 		if err == sql.ErrNoRows {
 			slog.Warn("Could not find row in database", "error", err)
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "tag not found", Tag: tag})
 			return
 		} else if err != nil {
 			slog.Warn("Database error", "error", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			internalError(w, ApiError{Message: "unable to read tag", Tag: tag})
 			return
 		}
 		slog.Debug("GET request for /tag/<TAG>", "tag", tag, "response", response)
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(response))
 		err = json.NewEncoder(w).Encode(response)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("Unable to write response", "error", err)
 			return
 		}
 
 	case "PUT":
-		value := query.Get("value")
-		if value == "" {
-			value = query.Get("val")
+		fValue, err := requestValue(r)
+		if err != nil {
+			slog.Error("Could not parse request value", "error", err)
+			writeError(w, bodyStatus(err), ApiError{Code: ErrorInvalidValue, Message: err.Error(), Tag: tag})
+			return
+		}
+		if !h.permittedTag(r, tag, types.RoleOperator) {
+			forbidden(w, ApiError{Message: "not permitted to write tag", Tag: tag})
+			return
 		}
-		if value != "" {
-			fValue, err := strconv.ParseFloat(value, 64)
-			if err != nil {
-				slog.Error("Could not parse request value as float", "error", err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
 
-			}
+		slog.Info("Updating tag " + tag + " with value " +
+			strconv.FormatFloat(fValue, 'f', -1, 64))
+		err = h.setValue(r, "tag", tag, fValue, apiOrigin(w, r))
+		if status, apiErr, refused := writeRefused(err); refused {
+			apiErr.Tag = tag
+			writeError(w, status, apiErr)
+			return
+		} else if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "tag not found", Tag: tag})
+			return
+		} else if err != nil {
+			slog.Error("Could not set tag value", "error", err)
+			internalError(w, ApiError{Message: "unable to set tag value", Tag: tag})
+			return
+		}
+		if written, err := h.db.GetRowByTag(tag); err == nil {
+			w.Header().Set("ETag", etag(written))
+		}
+		w.WriteHeader(http.StatusOK)
 
-			slog.Info("Updating tag " + tag + " with value " +
-				strconv.FormatFloat(fValue, 'f', -1, 64))
-			err = h.db.SetTagValue(tag, fValue)
-			if err != nil {
-				slog.Error("Could not set tag value", "error", err)
-				w.WriteHeader(http.StatusInternalServerError)
+	default:
+		methodNotAllowed(w, r, "GET, PUT")
+	}
+}
+
+// ValueBody is the JSON body of a write
+type ValueBody struct {
+	Value *float64 `json:"value"`
+}
+
+// requestValue reads the value to write from ?value= (or ?val=) or, without
+// either, from a JSON body such as {"value": 1.5}
+func requestValue(r *http.Request) (float64, error) {
+	query := r.URL.Query()
+	value := query.Get("value")
+	if value == "" {
+		value = query.Get("val")
+	}
+	if value != "" {
+		fValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, errors.New("value " + strconv.Quote(value) + " is not a number")
+		}
+		return fValue, nil
+	}
+
+	if r.Body == nil || r.ContentLength == 0 {
+		return 0, errors.New("missing value")
+	}
+	if err := requireJson(r); err != nil {
+		return 0, err
+	}
+	var body ValueBody
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&body)
+	if err == io.EOF || (err == nil && body.Value == nil) {
+		return 0, errors.New("missing value")
+	} else if err != nil {
+		return 0, errors.New("invalid body: " + err.Error())
+	}
+	return *body.Value, nil
+}
+
+// Longest a request may wait for a change
+const maxWait = 5 * time.Minute
+
+// waitForTag answers GET /tag/<tag>?wait=<duration>&since=<last_update> once
+// the tag's last_update differs from since, or on its next change without
+// since.  since_version=<version> does the same with the tag's version, which
+// tells apart writes within the same second.  No Content is returned if nothing
+// changes within the wait.
+func (h Handler) waitForTag(w http.ResponseWriter, r *http.Request, tag string) {
+	query := r.URL.Query()
+	wait, err := time.ParseDuration(query.Get("wait"))
+	if err != nil || wait < 0 {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "wait " + strconv.Quote(query.Get("wait")) + " is not a duration such as 30s", Tag: tag})
+		return
+	}
+	wait = min(wait, maxWait)
+	var sinceVersion int64
+	if query.Has("since_version") {
+		sinceVersion, err = strconv.ParseInt(query.Get("since_version"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "since_version " + strconv.Quote(query.Get("since_version")) + " is not a version", Tag: tag})
+			return
+		}
+	}
+
+	// Subscribe before reading so a change between the two isn't missed
+	sub := h.db.Changes.Subscribe(eventBuffer)
+	defer sub.Close()
+	response, err := h.db.GetRowByTag(tag)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "tag not found", Tag: tag})
+		return
+	} else if err != nil {
+		slog.Warn("Database error", "error", err)
+		internalError(w, ApiError{Message: "unable to read tag", Tag: tag})
+		return
+	}
+
+	// A bit's value lives in its register, which is what Modbus writes change
+	register, _, _ := strings.Cut(response.Address, "_")
+	written := query.Has("since") && response.LastUpdate != query.Get("since") ||
+		query.Has("since_version") && response.Version != sinceVersion
+	if !written {
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+		changed := false
+		for !changed {
+			select {
+			case change, open := <-sub.C:
+				// A closed subscription fell behind, so the tag may have changed
+				changed = !open || change.Tag == tag || change.Address == register
+			case <-timeout.C:
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case <-r.Context().Done():
 				return
 			}
-			w.WriteHeader(http.StatusOK)
+		}
+		response, err = h.db.GetRowByTag(tag)
+		if err != nil {
+			slog.Warn("Database error", "error", err)
+			internalError(w, ApiError{Message: "unable to read tag", Tag: tag})
 			return
 		}
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Header().Set("Allow", "GET, PUT")
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(response))
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		slog.Error("Unable to write response", "error", err)
 	}
 }
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// Group is a node of the tag hierarchy: the groups directly below it and every
+// tag at or below it
+type Group struct {
+	Path   string                 `json:"path"`
+	Groups []GroupSummary         `json:"groups"`
+	Tags   []types.ModbusResponse `json:"tags"`
+}
+
+// GroupSummary names a child group and how many tags are at or below it
+type GroupSummary struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Count int    `json:"count"`
+}
+
+// GetGroup browses the tag hierarchy built from each tag's path.  /groups/
+// is the root, holding every tag the request may view.  Tags can be filtered, sorted and paged with
+// the parameters of GetRegisters.
+func (h Handler) GetGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	group := strings.Trim(strings.TrimPrefix(r.URL.Path, "/groups"), "/")
+	if !types.ValidGroupPath(group) {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "invalid group path " + strconv.Quote(group)})
+		return
+	}
+	query, err := registerQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: err.Error()})
+		return
+	}
+
+	current := h.visibleRegisters(r)
+	children := map[string]int{}
+	found := group == ""
+	query.Tags = make([]string, 0, len(current))
+	for tag, register := range current {
+		query.Tags = append(query.Tags, string(tag))
+		below, isBelow := strings.CutPrefix(register.Path, group+"/")
+		if group == "" {
+			below, isBelow = register.Path, register.Path != ""
+		}
+		found = found || isBelow || register.Path == group
+		if isBelow {
+			name, _, _ := strings.Cut(below, "/")
+			children[name]++
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "group " + strconv.Quote(group) + " not found"})
+		return
+	}
+
+	response := Group{Path: group, Groups: []GroupSummary{}}
+	for name, count := range children {
+		childPath := name
+		if group != "" {
+			childPath = group + "/" + name
+		}
+		response.Groups = append(response.Groups, GroupSummary{Name: name, Path: childPath, Count: count})
+	}
+	slices.SortFunc(response.Groups, func(a, b GroupSummary) int { return strings.Compare(a.Name, b.Name) })
+
+	query.Group = group
+	var total int
+	response.Tags, total, err = h.db.QueryRows(query)
+	if err != nil {
+		slog.Error("Unable to get group", "group", group, "err", err.Error())
+		internalError(w, ApiError{Message: "unable to read registers"})
+		return
+	}
+	w.Header().Add("X-Total-Count", strconv.Itoa(total))
+	writeJson(w, http.StatusOK, response)
+}
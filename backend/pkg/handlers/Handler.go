@@ -1,36 +1,117 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/dshargool/go-mbslave-api.git/pkg/types"
 	"github.com/simonvetter/modbus"
 )
 
 type Handler struct {
-	registers          map[types.InstrumentTag]types.ModbusTag
+	registers          *RegisterMap
 	db                 *types.SqlDb
 	MbSlave            *modbus.ModbusServer
 	AllowNullRegisters bool
+	// ConfigPath is the configuration file reread on reload
+	ConfigPath string
+	// ConfigOverrides are the environment and flag overrides applied on reload
+	ConfigOverrides []types.ConfigOverride
+	// auth is shared by every copy so a reload changes the tokens for all of them
+	auth *atomic.Pointer[types.AuthConfig]
+}
+
+// RegisterMap holds the live register map.  Handlers are passed around by value
+// so the map lives behind a pointer shared by every copy, letting a reload swap
+// it for the API and Modbus server at once.
+type RegisterMap struct {
+	current atomic.Pointer[map[types.InstrumentTag]types.ModbusTag]
+	// Held while the map and database are being changed
+	update sync.Mutex
+	// orphanPolicy handles the rows of removed tags; guarded by update
+	orphanPolicy string
+}
+
+func NewRegisterMap(registers map[types.InstrumentTag]types.ModbusTag) *RegisterMap {
+	m := &RegisterMap{}
+	m.current.Store(&registers)
+	return m
+}
+
+// Get returns the current register map, which must not be modified
+func (m *RegisterMap) Get() map[types.InstrumentTag]types.ModbusTag {
+	return *m.current.Load()
+}
+
+func (m *RegisterMap) swap(registers map[types.InstrumentTag]types.ModbusTag) {
+	m.current.Store(&registers)
 }
 
 func New(config types.Configuration, db *types.SqlDb) Handler {
-	return Handler{
-		registers:          config.Registers,
+	h := Handler{
+		registers:          NewRegisterMap(config.Registers),
 		db:                 db,
 		MbSlave:            nil,
 		AllowNullRegisters: config.AllowNullRegister,
+		auth:               &atomic.Pointer[types.AuthConfig]{},
 	}
+	h.auth.Store(&config.Auth)
+	h.registers.orphanPolicy = config.OrphanPolicy
+	return h
+}
+
+// ApiPrefix is the prefix of the versioned API routes.  The same routes are
+// served without it for older clients.
+const ApiPrefix = "/api/v1"
+
+// Routes returns every API route, served both under ApiPrefix and at the root,
+// behind the configured tokens and allowed origins
+func (h Handler) Routes() http.Handler {
+	mux := http.NewServeMux()
+	routes := h.routes()
+	for _, route := range routes {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+	mux.HandleFunc("/", notFound)
+	api := h.authorize(mux, routes)
+
+	root := http.NewServeMux()
+	root.Handle(ApiPrefix+"/", http.StripPrefix(ApiPrefix, api))
+	root.Handle("/", api)
+	return h.cors(root)
 }
 
 func (h Handler) HandleRequests(port int) {
-	http.HandleFunc("/all_registers", h.GetRegisters)
-	http.HandleFunc("/tag/", h.GetTag)
-	http.HandleFunc("/register/", h.GetRegister)
-	http.HandleFunc("/healthcheck", h.Healthcheck)
-	if err := http.ListenAndServe(":"+strconv.Itoa(port), nil); err != nil {
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), h.Routes()); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// newRequestId generates an identifier for requests that didn't bring their own
+func newRequestId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// apiOrigin describes a write made through the REST API by the request's token.
+// A client supplied X-Request-ID is kept so writes can be traced back to the
+// caller's logs.
+func apiOrigin(w http.ResponseWriter, r *http.Request) types.WriteOrigin {
+	requestId := r.Header.Get("X-Request-ID")
+	if requestId == "" {
+		requestId = newRequestId()
+	}
+	w.Header().Set("X-Request-ID", requestId)
+	return types.WriteOrigin{
+		Source:     types.SourceApi,
+		ClientAddr: r.RemoteAddr,
+		RequestId:  requestId,
+		Actor:      actor(r),
+	}
+}
@@ -1,17 +1,31 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+	"github.com/gorilla/websocket"
 	"github.com/simonvetter/modbus"
 )
 
@@ -25,8 +39,14 @@ var (
 	valid_reg      string = "4"
 	valid_reg_next string = "6"
 	digital_reg    string = "10"
+	stale_reg      string = "20"
+	initial_reg    string = "21"
+	initialValue          = 42.0
+	staleValue            = 7.0
 )
 
+var testOrigin = types.WriteOrigin{Source: types.SourceConfig}
+
 var testConfig types.Configuration = types.Configuration{
 	ApiPort:           8081,
 	ModbusPort:        5502,
@@ -53,12 +73,14 @@ func setupTestSuite() testHandler {
 			Description: "Test",
 			Address:     valid_reg,
 			DataType:    "float32",
+			Path:        "Area1/Unit1",
 		},
 		{
 			Tag:         "ValidTagF32_2",
 			Description: "Test",
 			Address:     valid_reg_next,
 			DataType:    "float32",
+			Path:        "Area1/Unit2",
 		},
 		{
 			Tag:         "SampleTagF32",
@@ -90,6 +112,23 @@ func setupTestSuite() testHandler {
 			Address:     digital_reg + "_3",
 			DataType:    "digital",
 		},
+		{
+			Tag:         "StaleTagU16",
+			Description: "Stale",
+			Address:     stale_reg,
+			DataType:    "uint16",
+			Path:        "Area2",
+			MaxAge:      "1m",
+			OnStale:     types.StaleSubstitute,
+			StaleValue:  &staleValue,
+		},
+		{
+			Tag:          "InitialTagU16",
+			Description:  "Initial",
+			Address:      initial_reg,
+			DataType:     "uint16",
+			InitialValue: &initialValue,
+		},
 		{
 			Tag:         "SampleTagDigital11_0",
 			Description: "Digital3",
@@ -104,10 +143,11 @@ func setupTestSuite() testHandler {
 	_ = myDb.CreateTable()
 	myDb.UpdateTableTags(testConfig.Registers)
 	// Set a valid value to our 'ValidTag' address in the test db
-	_ = myDb.SetAddressValue(valid_reg, 100.0)
-	_ = myDb.SetAddressValue(valid_reg_next, 100.0)
-	_ = myDb.SetAddressValue("16", 1123.4)
-	_ = myDb.SetAddressValue(digital_reg+"_0", 1)
+	_ = myDb.SetAddressValue(valid_reg, 100.0, testOrigin)
+	_ = myDb.SetAddressValue(valid_reg_next, 100.0, testOrigin)
+	_ = myDb.SetAddressValue("16", 1123.4, testOrigin)
+	_ = myDb.SetAddressValue(digital_reg+"_0", 1, testOrigin)
+	_ = myDb.SetAddressValue(stale_reg, 3, testOrigin)
 
 	myHandler := New(testConfig, &myDb)
 
@@ -155,7 +195,7 @@ func TestGetRegisters(t *testing.T) {
 
 func TestGetNullValueTagF32(t *testing.T) {
 	testHandler := setupTestSuite()
-	expected := 500
+	expected := 200
 
 	request, _ := http.NewRequest(http.MethodGet, "/tag/TestTagF32", nil)
 	response := httptest.NewRecorder()
@@ -166,12 +206,17 @@ func TestGetNullValueTagF32(t *testing.T) {
 	if res != expected {
 		t.Errorf("Got %d, expected %d", res, expected)
 	}
+	var respValue types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&respValue)
+	if respValue.Value != nil || respValue.Initialized {
+		t.Errorf("Got %+v, expected an uninitialized null value", respValue)
+	}
 	testHandler.cleanUp()
 }
 
 func TestGetNullRegisterF32(t *testing.T) {
 	testHandler := setupTestSuite()
-	expected := 500
+	expected := 200
 
 	request, _ := http.NewRequest(http.MethodGet, "/register/"+null_reg, nil)
 	response := httptest.NewRecorder()
@@ -182,6 +227,11 @@ func TestGetNullRegisterF32(t *testing.T) {
 	if res != expected {
 		t.Errorf("Got %d, expected %d", res, expected)
 	}
+	var respValue types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&respValue)
+	if respValue.Value != nil || respValue.Initialized {
+		t.Errorf("Got %+v, expected an uninitialized null value", respValue)
+	}
 	testHandler.cleanUp()
 }
 
@@ -313,8 +363,8 @@ func TestPutGetWriteback(t *testing.T) {
 	_ = dec.Decode(&respValue)
 	fmt.Println(respValue)
 
-	if respValue.Value != expected {
-		t.Errorf("Got %.2f, expected %.2f", respValue.Value, expected)
+	if respValue.ValueOr(math.NaN()) != expected {
+		t.Errorf("Got %.2f, expected %.2f", respValue.ValueOr(math.NaN()), expected)
 	}
 	testHandler.cleanUp()
 }
@@ -438,8 +488,8 @@ func TestModbusWriteApiReadF32(t *testing.T) {
 	var apiValue types.ModbusResponse
 	_ = dec.Decode(&apiValue)
 
-	if float32(apiValue.Value) != mbValue {
-		t.Errorf("Api %.2f, Modbus %.2f", apiValue.Value, mbValue)
+	if float32(apiValue.ValueOr(math.NaN())) != mbValue {
+		t.Errorf("Api %.2f, Modbus %.2f", apiValue.ValueOr(math.NaN()), mbValue)
 	}
 	testHandler.cleanUp()
 }
@@ -466,10 +516,10 @@ func TestModbusWriteMultipleApiRead(t *testing.T) {
 		var apiValue types.ModbusResponse
 		_ = dec.Decode(&apiValue)
 
-		if float32(apiValue.Value) != float32(expected) {
-			t.Errorf("Api %.2f, Modbus %.2f", apiValue.Value, expected)
+		if float32(apiValue.ValueOr(math.NaN())) != float32(expected) {
+			t.Errorf("Api %.2f, Modbus %.2f", apiValue.ValueOr(math.NaN()), expected)
 		} else {
-            t.Logf("Api %.2f, Modbus %.2f", apiValue.Value, expected)
+            t.Logf("Api %.2f, Modbus %.2f", apiValue.ValueOr(math.NaN()), expected)
         }
 	}
 	{
@@ -484,8 +534,8 @@ func TestModbusWriteMultipleApiRead(t *testing.T) {
 		var apiValue types.ModbusResponse
 		_ = dec.Decode(&apiValue)
 
-		if float32(apiValue.Value) != float32(expected+1) {
-			t.Errorf("Api %.2f, Modbus %.2f", apiValue.Value, expected+1)
+		if float32(apiValue.ValueOr(math.NaN())) != float32(expected+1) {
+			t.Errorf("Api %.2f, Modbus %.2f", apiValue.ValueOr(math.NaN()), expected+1)
 		}
 	}
 
@@ -536,7 +586,7 @@ func TestApiDigitalWriteRead(t *testing.T) {
 	var respValue types.ModbusResponse
 	_ = dec.Decode(&respValue)
 
-	valStr := strconv.FormatFloat(respValue.Value, 'f', -1, 64)
+	valStr := strconv.FormatFloat(respValue.ValueOr(math.NaN()), 'f', -1, 64)
 	if expected != valStr {
 		t.Errorf("Got %s, expected %s", valStr, expected)
 	}
@@ -578,7 +628,7 @@ func TestModbusDigitalWriteApiRead(t *testing.T) {
 	dec := json.NewDecoder(response.Body)
 	var respValue types.ModbusResponse
 	_ = dec.Decode(&respValue)
-	valStr := strconv.FormatFloat(respValue.Value, 'f', -1, 64)
+	valStr := strconv.FormatFloat(respValue.ValueOr(math.NaN()), 'f', -1, 64)
 
 	if expected != valStr {
 		t.Errorf("Got %s, expected %s", valStr, expected)
@@ -601,7 +651,7 @@ func TestMultipleModbusDigitalWriteApiRead(t *testing.T) {
 	dec := json.NewDecoder(response.Body)
 	var respValue types.ModbusResponse
 	_ = dec.Decode(&respValue)
-	valStr := strconv.FormatFloat(respValue.Value, 'f', -1, 64)
+	valStr := strconv.FormatFloat(respValue.ValueOr(math.NaN()), 'f', -1, 64)
 
 	if expected != valStr {
 		t.Errorf("Got %s, expected %s", valStr, expected)
@@ -615,7 +665,7 @@ func TestMultipleModbusDigitalWriteApiRead(t *testing.T) {
 	dec := json.NewDecoder(response.Body)
 	var respValue types.ModbusResponse
 	_ = dec.Decode(&respValue)
-	valStr := strconv.FormatFloat(respValue.Value, 'f', -1, 64)
+	valStr := strconv.FormatFloat(respValue.ValueOr(math.NaN()), 'f', -1, 64)
 
 	if "0" != valStr {
 		t.Errorf("Got %s, expected %s", valStr, "0")
@@ -637,7 +687,7 @@ func TestModbusDigitalWriteApiTagRead(t *testing.T) {
 	dec := json.NewDecoder(response.Body)
 	var respValue types.ModbusResponse
 	_ = dec.Decode(&respValue)
-	valStr := strconv.FormatFloat(respValue.Value, 'f', -1, 64)
+	valStr := strconv.FormatFloat(respValue.ValueOr(math.NaN()), 'f', -1, 64)
 
 	if expected != valStr {
 		t.Errorf("Got %s, expected %s", valStr, expected)
@@ -666,3 +716,2176 @@ func TestApiTagWriteModbusRead(t *testing.T) {
 	}
 	testHandler.cleanUp()
 }
+
+func TestDigitalReadsRegister(t *testing.T) {
+	testHandler := setupTestSuite()
+	defer testHandler.cleanUp()
+	db := testHandler.handler.db
+
+	// A bit of a register that has never been written has no value
+	row, _ := db.GetRowByTag("SampleTagDigital11_0")
+	rows, _, _ := db.QueryRows(types.RegisterQuery{Tags: []string{"SampleTagDigital11_0"}})
+	if row.Value != nil || row.Initialized || len(rows) != 1 || rows[0].Value != nil || rows[0].Initialized {
+		t.Errorf("Got %+v and %+v, expected no value", row, rows)
+	}
+
+	// Bits follow their register after being written on their own
+	_ = db.SetTagValue("SampleTagDigital0", 1, testOrigin)
+	_ = testHandler.mb_client.WriteRegister(10, 0b0110)
+	_ = db.SetTagValue("SampleTagDigital1", 0, testOrigin)
+	register, _ := db.GetRowByAddress(digital_reg)
+	rows, _, _ = db.QueryRows(types.RegisterQuery{TagPatterns: []string{"SampleTagDigital?"}})
+	if register.ValueOr(-1) != 0b0100 || len(rows) != 4 {
+		t.Fatalf("Got register %v and %+v", register.ValueOr(-1), rows)
+	}
+	for i, expected := range []float64{0, 0, 1, 0} {
+		row, _ := db.GetRowByTag(rows[i].Tag)
+		if rows[i].ValueOr(-1) != expected || row.ValueOr(-1) != expected {
+			t.Errorf("%s: got %v and %v, expected %v", rows[i].Tag, rows[i].ValueOr(-1), row.ValueOr(-1), expected)
+		}
+	}
+}
+
+// setupBenchRegisters adds a contiguous block of uint16 tags for poll benchmarks
+func setupBenchRegisters(b *testing.B, start int, count int) *types.SqlDb {
+	myDb := types.SqlDb{}
+	if err := myDb.Open(testConfig.DBPath); err != nil {
+		b.Fatal(err)
+	}
+	if err := myDb.CreateTable(); err != nil {
+		b.Fatal(err)
+	}
+	registers := map[types.InstrumentTag]types.ModbusTag{}
+	for i := 0; i < count; i++ {
+		addr := strconv.Itoa(start + i)
+		registers[types.InstrumentTag("BenchTag"+addr)] = types.ModbusTag{
+			Tag:         "BenchTag" + addr,
+			Description: "Bench",
+			Address:     addr,
+			DataType:    "uint16",
+		}
+	}
+	myDb.UpdateTableTags(registers)
+	for i := 0; i < count; i++ {
+		_ = myDb.SetAddressValue(strconv.Itoa(start+i), float64(i), testOrigin)
+	}
+	return &myDb
+}
+
+func BenchmarkModbusPoll125PerRegister(b *testing.B) {
+	slog.SetLogLoggerLevel(slog.LevelError)
+	defer slog.SetLogLoggerLevel(slog.LevelInfo)
+	myDb := setupBenchRegisters(b, 100, 125)
+	defer os.Remove(testConfig.DBPath)
+	defer myDb.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		// The previous read path; two queries per register
+		for i := 0; i < 125; i++ {
+			addr := strconv.Itoa(100 + i)
+			dataType, _ := myDb.GetDataTypeByAddress(addr)
+			row, _ := myDb.GetRowByAddress(addr)
+			_, _ = parseDataTypeToByte(dataType, row.ValueOr(0))
+		}
+	}
+}
+
+func BenchmarkModbusPoll125Range(b *testing.B) {
+	slog.SetLogLoggerLevel(slog.LevelError)
+	defer slog.SetLogLoggerLevel(slog.LevelInfo)
+	myDb := setupBenchRegisters(b, 100, 125)
+	defer os.Remove(testConfig.DBPath)
+	defer myDb.Close()
+	handler := New(testConfig, myDb)
+	req := &modbus.HoldingRegistersRequest{Addr: 100, Quantity: 125}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		res, err := handler.HandleHoldingRegisters(req)
+		if err != nil || len(res) != 125 {
+			b.Fatalf("Got %d registers, err %v", len(res), err)
+		}
+	}
+}
+
+func TestModbusRangeReadNullValue(t *testing.T) {
+	testHandler := setupTestSuite()
+	mbClient := testHandler.mb_client
+
+	// The null register is configured but has no value so it can't be read
+	regAddr, _ := strconv.Atoi(null_reg)
+	_, err := mbClient.ReadRegisters(uint16(regAddr), 4, modbus.HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("Expected error reading null register range")
+	}
+	testHandler.cleanUp()
+}
+
+func TestBackupRestore(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	// Take a snapshot while ValidTagF32 is 100
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/admin/backup", nil)
+	testHandler.handler.Backup(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", response.Code, http.StatusOK)
+	}
+	snapshot := response.Body.Bytes()
+	backedUp, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+
+	_ = testHandler.handler.db.SetTagValue("ValidTagF32", 5, testOrigin)
+	written, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+	writtenBit, _ := testHandler.handler.db.GetRowByTag("SampleTagDigital0")
+
+	// A restore that can't reapply the registers is undone as a whole
+	testHandler.handler.registers.orphanPolicy = "unknown"
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(snapshot))
+	testHandler.handler.Restore(response, request)
+	row, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+	if response.Code != http.StatusInternalServerError || row.ValueOr(math.NaN()) != 5 {
+		t.Errorf("Got %d with %.2f, expected %d with the value kept", response.Code, row.ValueOr(math.NaN()), http.StatusInternalServerError)
+	}
+	testHandler.handler.registers.orphanPolicy = ""
+
+	sub := testHandler.handler.db.Changes.Subscribe(eventBuffer)
+	defer sub.Close()
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(snapshot))
+	testHandler.handler.Restore(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", response.Code, http.StatusOK)
+	}
+
+	row, _ = testHandler.handler.db.GetRowByTag("ValidTagF32")
+	if row.ValueOr(math.NaN()) != 100 {
+		t.Errorf("Got %.2f, expected %.2f", row.ValueOr(math.NaN()), 100.0)
+	}
+	// Versions carry on past those handed out before the restore, so an ETag
+	// read since the backup can't match again
+	bit, _ := testHandler.handler.db.GetRowByTag("SampleTagDigital0")
+	if row.Version <= written.Version || bit.Version <= writtenBit.Version {
+		t.Errorf("Got versions %d and %d after %d and %d", row.Version, bit.Version, written.Version, writtenBit.Version)
+	}
+	err := testHandler.handler.db.SetTagValueIfVersion("ValidTagF32", 6, backedUp.Version, testOrigin)
+	if !errors.Is(err, types.ErrVersionMismatch) {
+		t.Errorf("Got %v writing with the version backed up", err)
+	}
+	// Only the value the restore changed is published
+	select {
+	case change := <-sub.C:
+		if change.Tag != "ValidTagF32" || change.Value != 100 || change.Source != types.SourceApi {
+			t.Errorf("Got %+v", change)
+		}
+	default:
+		t.Errorf("The restored value wasn't published")
+	}
+	select {
+	case change := <-sub.C:
+		t.Errorf("Got %+v, expected only ValidTagF32", change)
+	default:
+	}
+	entries, _, _ := testHandler.handler.db.QueryAudit(types.AuditQuery{Actions: []string{types.AuditRestore}})
+	if len(entries) != 1 || entries[0].Source != types.SourceApi {
+		t.Errorf("Got %+v, expected the restore audited", entries)
+	}
+	testHandler.cleanUp()
+}
+
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	testHandler := setupTestSuite()
+	expected := 400
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, "/admin/restore", strings.NewReader("not a database"))
+	testHandler.handler.Restore(response, request)
+
+	if response.Code != expected {
+		t.Errorf("Got %d, expected %d", response.Code, expected)
+	}
+	testHandler.cleanUp()
+}
+
+func TestPutTagRecordsOrigin(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	data := url.Values{}
+	data.Add("value", "42")
+	request, _ := http.NewRequest(http.MethodPut, "/tag/ValidTagF32", nil)
+	request.URL.RawQuery = data.Encode()
+	request.Header.Set("X-Request-ID", "test-request")
+	request.RemoteAddr = "10.0.0.1:1234"
+	testHandler.handler.GetTag(httptest.NewRecorder(), request)
+
+	response := httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/tag/ValidTagF32", nil)
+	testHandler.handler.GetTag(response, request)
+	var respValue types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&respValue)
+
+	expected := types.WriteOrigin{Source: types.SourceApi, ClientAddr: "10.0.0.1:1234", RequestId: "test-request"}
+	if respValue.WriteOrigin != expected {
+		t.Errorf("Got %+v, expected %+v", respValue.WriteOrigin, expected)
+	}
+	testHandler.cleanUp()
+}
+
+func TestModbusWriteHistory(t *testing.T) {
+	testHandler := setupTestSuite()
+	mbClient := testHandler.mb_client
+
+	regAddr, _ := strconv.Atoi(valid_reg)
+	_ = mbClient.WriteFloat32(uint16(regAddr), 12.5)
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/history/ValidTagF32?limit=1", nil)
+	testHandler.handler.GetHistory(response, request)
+	var history []types.HistoryEntry
+	_ = json.NewDecoder(response.Body).Decode(&history)
+
+	if len(history) != 1 {
+		t.Fatalf("Got %d entries, expected %d", len(history), 1)
+	}
+	if history[0].Value == nil || *history[0].Value != 12.5 || history[0].Source != types.SourceModbus || history[0].ClientAddr == "" {
+		t.Errorf("Got %+v, expected modbus write of 12.5", history[0])
+	}
+	testHandler.cleanUp()
+}
+
+// expireTag pushes a tag's last update back far enough for it to be stale
+func (h *testHandler) expireTag(tag string) {
+	_, _ = h.handler.db.Exec("UPDATE datapoints SET last_update = '2000-01-01 00:00:00' WHERE tag = $1", tag)
+}
+
+func TestGetTagQuality(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	getQuality := func() string {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/tag/StaleTagU16", nil)
+		testHandler.handler.GetTag(response, request)
+		var respValue types.ModbusResponse
+		_ = json.NewDecoder(response.Body).Decode(&respValue)
+		return respValue.Quality
+	}
+
+	if quality := getQuality(); quality != types.QualityGood {
+		t.Errorf("Got %s, expected %s", quality, types.QualityGood)
+	}
+	testHandler.expireTag("StaleTagU16")
+	if quality := getQuality(); quality != types.QualityStale {
+		t.Errorf("Got %s, expected %s", quality, types.QualityStale)
+	}
+	testHandler.cleanUp()
+}
+
+func TestGetRegistersUninitializedQuality(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/all_registers", nil)
+	testHandler.handler.GetRegisters(response, request)
+	var registers []types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&registers)
+
+	for _, register := range registers {
+		if register.Tag == "TestTagF32" && register.Quality != types.QualityUninitialized {
+			t.Errorf("Got %s, expected %s", register.Quality, types.QualityUninitialized)
+		}
+	}
+	testHandler.cleanUp()
+}
+
+func TestModbusStaleSubstitute(t *testing.T) {
+	testHandler := setupTestSuite()
+	mbClient := testHandler.mb_client
+	var expected uint16 = 7
+
+	testHandler.expireTag("StaleTagU16")
+	regAddr, _ := strconv.Atoi(stale_reg)
+	res, _ := mbClient.ReadRegister(uint16(regAddr), modbus.HOLDING_REGISTER)
+	if res != expected {
+		t.Errorf("Got %d, expected %d", res, expected)
+	}
+	testHandler.cleanUp()
+}
+
+func TestModbusStaleException(t *testing.T) {
+	testHandler := setupTestSuite()
+	mbClient := testHandler.mb_client
+
+	testHandler.expireTag("StaleTagU16")
+	_, _ = testHandler.handler.db.Exec("UPDATE datapoints SET on_stale = $1 WHERE tag = 'StaleTagU16'", types.StaleException)
+	regAddr, _ := strconv.Atoi(stale_reg)
+	_, err := mbClient.ReadRegister(uint16(regAddr), modbus.HOLDING_REGISTER)
+	if err != modbus.ErrServerDeviceFailure {
+		t.Errorf("Got %v, expected %v", err, modbus.ErrServerDeviceFailure)
+	}
+	testHandler.cleanUp()
+}
+
+func TestInitialValueApplied(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	row, err := testHandler.handler.db.GetRowByTag("InitialTagU16")
+	if err != nil || !row.Initialized || row.ValueOr(math.NaN()) != initialValue {
+		t.Errorf("Got %+v (%v), expected initialized value %.2f", row, err, initialValue)
+	}
+	if row.Source != types.SourceConfig {
+		t.Errorf("Got source %s, expected %s", row.Source, types.SourceConfig)
+	}
+
+	// Initial values never overwrite a value that has been written
+	_ = testHandler.handler.db.SetTagValue("InitialTagU16", 5, testOrigin)
+	testHandler.handler.db.UpdateTableTags(testConfig.Registers)
+	row, _ = testHandler.handler.db.GetRowByTag("InitialTagU16")
+	if row.ValueOr(math.NaN()) != 5 {
+		t.Errorf("Got %.2f, expected %.2f", row.ValueOr(math.NaN()), 5.0)
+	}
+	testHandler.cleanUp()
+}
+
+// registersWithout copies the test registers leaving out a tag
+func registersWithout(tag string) map[types.InstrumentTag]types.ModbusTag {
+	registers := map[types.InstrumentTag]types.ModbusTag{}
+	for key, register := range testConfig.Registers {
+		if key != types.InstrumentTag(tag) {
+			registers[key] = register
+		}
+	}
+	return registers
+}
+
+func TestReconcileOrphanPolicies(t *testing.T) {
+	for _, policy := range []string{types.OrphanKeep, types.OrphanDisable, types.OrphanArchive, types.OrphanDelete} {
+		testHandler := setupTestSuite()
+
+		report, err := testHandler.handler.db.ReconcileTags(registersWithout("SampleTagF32"), policy)
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		if len(report.Orphans) != 1 || report.Orphans[0].Address != "16" {
+			t.Errorf("%s: Got %+v, expected address 16 orphaned", policy, report.Orphans)
+		}
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/register/16", nil)
+		testHandler.handler.GetRegister(response, request)
+		expected := 404
+		if policy == types.OrphanKeep {
+			expected = 200
+		}
+		if response.Code != expected {
+			t.Errorf("%s: Got %d, expected %d", policy, response.Code, expected)
+		}
+
+		var archived int
+		_ = testHandler.handler.db.QueryRow("SELECT COUNT(*) FROM datapoints_archive WHERE address='16'").Scan(&archived)
+		if (policy == types.OrphanArchive) != (archived == 1) {
+			t.Errorf("%s: Got %d archived rows", policy, archived)
+		}
+
+		// Bringing the tag back re-enables a disabled row
+		testHandler.handler.db.UpdateTableTags(testConfig.Registers)
+		_, err = testHandler.handler.db.GetRowByTag("SampleTagF32")
+		if err != nil {
+			t.Errorf("%s: Got %v after restoring tag", policy, err)
+		}
+		testHandler.cleanUp()
+	}
+}
+
+func TestReconcileUnknownPolicy(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	_, err := testHandler.handler.db.ReconcileTags(testConfig.Registers, "shred")
+	if err == nil {
+		t.Errorf("Expected error for unknown orphan policy")
+	}
+	testHandler.cleanUp()
+}
+
+func TestGetRegistersCsv(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/registers.csv", nil)
+	testHandler.handler.GetRegistersCsv(response, request)
+
+	records, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(testConfig.Registers)+1 {
+		t.Fatalf("Got %d rows, expected %d", len(records), len(testConfig.Registers)+1)
+	}
+	header := records[0]
+	valueColumn := slices.Index(header, "value")
+	// Rows are in address order so the null register comes first
+	if records[1][slices.Index(header, "address")] != null_reg || records[1][valueColumn] != "" {
+		t.Errorf("Got %v, expected uninitialized register %s", records[1], null_reg)
+	}
+	if records[2][slices.Index(header, "tag")] != "ValidTagF32" || records[2][valueColumn] != "100" {
+		t.Errorf("Got %v, expected ValidTagF32 with value 100", records[2])
+	}
+	testHandler.cleanUp()
+}
+
+func TestReloadKeepsModbusConnected(t *testing.T) {
+	testHandler := setupTestSuite()
+	mbClient := testHandler.mb_client
+
+	// Reload a configuration that adds a tag and drops SampleTagF32
+	configData := types.ConfigurationData{ApiPort: testConfig.ApiPort, ModbusPort: testConfig.ModbusPort, OrphanPolicy: types.OrphanDisable}
+	for _, register := range registersWithout("SampleTagF32") {
+		configData.Registers = append(configData.Registers, register)
+	}
+	configData.Registers = append(configData.Registers, types.ModbusTag{
+		Tag: "ReloadedTagU16", Description: "Reloaded", Address: "30", DataType: "uint16",
+	})
+	raw, _ := types.EncodeConfig(configData, types.FormatJson)
+	testHandler.handler.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	_ = os.WriteFile(testHandler.handler.ConfigPath, raw, 0o644)
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, "/admin/reload", nil)
+	testHandler.handler.PostReload(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d: %s", response.Code, http.StatusOK, response.Body.String())
+	}
+	var report ReloadReport
+	_ = json.NewDecoder(response.Body).Decode(&report)
+	if !slices.Equal(report.Added, []string{"ReloadedTagU16"}) || !slices.Equal(report.Removed, []string{"SampleTagF32"}) {
+		t.Errorf("Got %+v", report)
+	}
+	if _, found := testHandler.handler.registers.Get()["ReloadedTagU16"]; !found {
+		t.Errorf("Reloaded tag missing from register map")
+	}
+
+	// The existing Modbus connection serves the new tag and no longer the removed one
+	err := mbClient.WriteRegister(30, 12)
+	if err != nil {
+		t.Errorf("Got %v writing reloaded register", err)
+	}
+	_, err = mbClient.ReadFloat32(16, modbus.HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("Expected error reading removed register")
+	}
+	testHandler.cleanUp()
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	testHandler := setupTestSuite()
+	testHandler.handler.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	_ = os.WriteFile(testHandler.handler.ConfigPath, []byte(`{"api_port": 0, "registers": []}`), 0o644)
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, "/admin/reload", nil)
+	testHandler.handler.PostReload(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusBadRequest)
+	}
+	if _, found := testHandler.handler.registers.Get()["ValidTagF32"]; !found {
+		t.Errorf("Register map changed by an invalid reload")
+	}
+	testHandler.cleanUp()
+}
+
+func TestCreateTagModbusReadback(t *testing.T) {
+	testHandler := setupTestSuite()
+	mbClient := testHandler.mb_client
+
+	response := httptest.NewRecorder()
+	body := `{"tag": "CreatedTagU16", "description": "Created", "address": "30", "datatype": "uint16"}`
+	request, _ := http.NewRequest(http.MethodPost, "/tags", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.TagDefinitions(response, request)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Got %d, expected %d: %s", response.Code, http.StatusCreated, response.Body.String())
+	}
+
+	// The Modbus server serves the new tag without a restart
+	err := mbClient.WriteRegister(30, 12)
+	if err != nil {
+		t.Errorf("Got %v writing created register", err)
+	}
+	value, err := mbClient.ReadRegister(30, modbus.HOLDING_REGISTER)
+	if err != nil || value != 12 {
+		t.Errorf("Got %d %v, expected 12", value, err)
+	}
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPost, "/tags", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.TagDefinitions(response, request)
+	if response.Code != http.StatusConflict {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusConflict)
+	}
+	testHandler.cleanUp()
+}
+
+func TestCreateTagInvalid(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	// Overlaps the float32 at valid_reg
+	response := httptest.NewRecorder()
+	body := `{"tag": "OverlapTagU16", "address": "5", "datatype": "uint16"}`
+	request, _ := http.NewRequest(http.MethodPost, "/tags", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.TagDefinitions(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusBadRequest)
+	}
+	if _, found := testHandler.handler.registers.Get()["OverlapTagU16"]; found {
+		t.Errorf("Invalid tag added to register map")
+	}
+	testHandler.cleanUp()
+}
+
+func TestPatchTagAddress(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPatch, "/tags/ValidTagF32", strings.NewReader(`{"address": "40"}`))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.TagDefinition(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d: %s", response.Code, http.StatusOK, response.Body.String())
+	}
+	register := testHandler.handler.registers.Get()["ValidTagF32"]
+	if register.Address != "40" || register.DataType != "float32" {
+		t.Errorf("Got %+v", register)
+	}
+
+	// Even the default keep policy disables the row a tag moved away from
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/register/"+valid_reg, nil)
+	testHandler.handler.GetRegister(response, request)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Got %d, expected %d for the old address", response.Code, http.StatusNotFound)
+	}
+	address, err := testHandler.handler.db.GetAddressByTag("ValidTagF32")
+	if err != nil || address != "40" {
+		t.Errorf("Got %s %v, expected 40", address, err)
+	}
+	testHandler.cleanUp()
+}
+
+func TestPatchTagRefusedLeavesTag(t *testing.T) {
+	testHandler := setupTestSuite()
+	patch := func(body string) int {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodPatch, "/tags/ValidTagF32", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		testHandler.handler.TagDefinition(response, request)
+		return response.Code
+	}
+	get := func() types.ModbusTag {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/tags/ValidTagF32", nil)
+		testHandler.handler.TagDefinition(response, request)
+		var register types.ModbusTag
+		_ = json.NewDecoder(response.Body).Decode(&register)
+		return register
+	}
+	if code := patch(`{"min": 0, "max": 10, "properties": {"a": "1"}}`); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+	before := get()
+
+	// min above max is refused without touching the live tag
+	if code := patch(`{"min": 50}`); code != http.StatusBadRequest {
+		t.Errorf("Got %d, expected %d", code, http.StatusBadRequest)
+	}
+	if after := get(); !reflect.DeepEqual(after, before) || *after.Min != 0 {
+		t.Errorf("Got %+v after a refused patch, expected %+v", after, before)
+	}
+
+	// Properties are replaced rather than merged
+	if code := patch(`{"properties": {"b": "2"}}`); code != http.StatusOK {
+		t.Errorf("Got %d, expected %d", code, http.StatusOK)
+	}
+	if after := get(); !reflect.DeepEqual(after.Properties, map[string]string{"b": "2"}) {
+		t.Errorf("Got properties %v, expected only b", after.Properties)
+	}
+	testHandler.cleanUp()
+}
+
+func TestAddTagOverDisabledRow(t *testing.T) {
+	testHandler := setupTestSuite()
+	testHandler.handler.registers.orphanPolicy = types.OrphanDisable
+	old, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodDelete, "/tags/ValidTagF32", nil)
+	testHandler.handler.TagDefinition(response, request)
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("Got %d, expected %d", response.Code, http.StatusNoContent)
+	}
+
+	// The new tag starts from its own initial value rather than the disabled row's
+	response = httptest.NewRecorder()
+	body := `{"tag": "ReusedTagU16", "address": "` + valid_reg + `", "datatype": "uint16", "initial_value": 3}`
+	request, _ = http.NewRequest(http.MethodPost, "/tags", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.TagDefinitions(response, request)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Got %d, expected %d: %s", response.Code, http.StatusCreated, response.Body.String())
+	}
+	row, err := testHandler.handler.db.GetRowByTag("ReusedTagU16")
+	if err != nil || row.ValueOr(0) != 3 || row.Version <= old.Version {
+		t.Errorf("Got %+v %v, expected value 3 after version %d", row, err, old.Version)
+	}
+	testHandler.cleanUp()
+}
+
+func TestDeleteTag(t *testing.T) {
+	testHandler := setupTestSuite()
+	testHandler.handler.registers.orphanPolicy = types.OrphanDelete
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodDelete, "/tags/ValidTagF32", nil)
+	testHandler.handler.TagDefinition(response, request)
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("Got %d, expected %d", response.Code, http.StatusNoContent)
+	}
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/register/"+valid_reg, nil)
+	testHandler.handler.GetRegister(response, request)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusNotFound)
+	}
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodDelete, "/tags/ValidTagF32", nil)
+	testHandler.handler.TagDefinition(response, request)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusNotFound)
+	}
+	testHandler.cleanUp()
+}
+
+func TestDeleteTagOrphanPolicy(t *testing.T) {
+	for _, policy := range []string{types.OrphanKeep, types.OrphanArchive} {
+		testHandler := setupTestSuite()
+		testHandler.handler.registers.orphanPolicy = policy
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodDelete, "/tags/ValidTagF32", nil)
+		testHandler.handler.TagDefinition(response, request)
+		if response.Code != http.StatusNoContent {
+			t.Fatalf("%s: Got %d, expected %d", policy, response.Code, http.StatusNoContent)
+		}
+
+		response = httptest.NewRecorder()
+		request, _ = http.NewRequest(http.MethodGet, "/register/"+valid_reg, nil)
+		testHandler.handler.GetRegister(response, request)
+		var archived int
+		_ = testHandler.handler.db.QueryRow("SELECT COUNT(*) FROM datapoints_archive WHERE address=$1", valid_reg).Scan(&archived)
+		switch policy {
+		case types.OrphanKeep:
+			if response.Code != http.StatusOK {
+				t.Errorf("%s: Got %d, expected the row kept", policy, response.Code)
+			}
+		case types.OrphanArchive:
+			if response.Code != http.StatusNotFound || archived != 1 {
+				t.Errorf("%s: Got %d with %d archived, expected the row archived", policy, response.Code, archived)
+			}
+		}
+		testHandler.cleanUp()
+	}
+}
+
+func TestTagSaveFailureRollsBack(t *testing.T) {
+	testHandler := setupTestSuite()
+	testHandler.handler.registers.orphanPolicy = types.OrphanDelete
+	testHandler.handler.ConfigPath = filepath.Join(t.TempDir(), "missing", "config.json")
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodDelete, "/tags/ValidTagF32?save=true", nil)
+	testHandler.handler.TagDefinition(response, request)
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("Got %d, expected %d", response.Code, http.StatusInternalServerError)
+	}
+	if _, found := testHandler.handler.registers.Get()["ValidTagF32"]; !found {
+		t.Errorf("Tag was removed from the register map")
+	}
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/register/"+valid_reg, nil)
+	testHandler.handler.GetRegister(response, request)
+	if response.Code != http.StatusOK {
+		t.Errorf("Got %d, expected the row left in the database", response.Code)
+	}
+	testHandler.cleanUp()
+}
+
+func TestTagAuditFailureRollsBack(t *testing.T) {
+	testHandler := setupTestSuite()
+	_, err := testHandler.handler.db.Exec(`CREATE TRIGGER audit_log_refuse BEFORE INSERT ON audit_log
+    WHEN NEW.action = 'tag_added' BEGIN SELECT RAISE(ABORT, 'refused'); END;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := httptest.NewRecorder()
+	body := `{"tag": "UnauditedTagU16", "address": "30", "datatype": "uint16"}`
+	request, _ := http.NewRequest(http.MethodPost, "/tags", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.TagDefinitions(response, request)
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("Got %d, expected %d", response.Code, http.StatusInternalServerError)
+	}
+	if _, found := testHandler.handler.registers.Get()["UnauditedTagU16"]; found {
+		t.Errorf("Tag was added to the register map without being audited")
+	}
+	if _, err := testHandler.handler.db.GetRowByAddress("30"); err != sql.ErrNoRows {
+		t.Errorf("Got %v, expected the row rolled back", err)
+	}
+	testHandler.cleanUp()
+}
+
+func TestAuditedRegisters(t *testing.T) {
+	testHandler := setupTestSuite()
+	db := testHandler.handler.db
+	registers := testHandler.handler.registers.Get()
+
+	// Startup audits the configuration against the tags last audited
+	if err := db.AuditRegisters(testOrigin, nil, registers); err != nil {
+		t.Fatal(err)
+	}
+	audited, err := db.AuditedRegisters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := types.DiffRegisters(audited, registers); len(diff.Added)+len(diff.Removed)+len(diff.Changed) != 0 {
+		t.Errorf("Got %+v between the audited and configured tags", diff)
+	}
+
+	removed := maps.Clone(registers)
+	delete(removed, "ValidTagF32")
+	if err := db.AuditRegisters(testOrigin, audited, removed); err != nil {
+		t.Fatal(err)
+	}
+	audited, _ = db.AuditedRegisters()
+	if _, found := audited["ValidTagF32"]; found || len(audited) != len(removed) {
+		t.Errorf("Got %d audited tags, expected %d without ValidTagF32", len(audited), len(removed))
+	}
+	testHandler.cleanUp()
+}
+
+func TestCreateTagSaveConfig(t *testing.T) {
+	testHandler := setupTestSuite()
+	configData := types.ConfigurationData{ApiPort: testConfig.ApiPort, ModbusPort: testConfig.ModbusPort}
+	for _, register := range sortedRegisters(testHandler.handler.registers.Get()) {
+		configData.Registers = append(configData.Registers, register)
+	}
+	raw, _ := types.EncodeConfig(configData, types.FormatJson)
+	testHandler.handler.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	_ = os.WriteFile(testHandler.handler.ConfigPath, raw, 0o644)
+
+	response := httptest.NewRecorder()
+	body := `{"tag": "SavedTagU16", "address": "30", "datatype": "uint16"}`
+	request, _ := http.NewRequest(http.MethodPost, "/tags?save=true", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.TagDefinitions(response, request)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Got %d, expected %d: %s", response.Code, http.StatusCreated, response.Body.String())
+	}
+
+	saved, err := types.Configuration{}.ReadConfig(testHandler.handler.ConfigPath)
+	if err != nil {
+		t.Fatalf("Got %v reading saved configuration", err)
+	}
+	if _, found := saved.Registers["SavedTagU16"]; !found {
+		t.Errorf("Created tag missing from saved configuration")
+	}
+	if len(saved.Registers) != len(testHandler.handler.registers.Get()) {
+		t.Errorf("Got %d saved registers, expected %d", len(saved.Registers), len(testHandler.handler.registers.Get()))
+	}
+	testHandler.cleanUp()
+}
+
+func decodeApiError(t *testing.T, response *httptest.ResponseRecorder) ApiError {
+	var body ErrorResponse
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatalf("Got %v decoding error body", err)
+	}
+	return body.Error
+}
+
+func TestApiV1UnknownTag(t *testing.T) {
+	testHandler := setupTestSuite()
+	routes := testHandler.handler.Routes()
+
+	for _, path := range []string{"/api/v1/tag/UnknownTag", "/tag/UnknownTag"} {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		routes.ServeHTTP(response, request)
+		if response.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, expected %d", path, response.Code, http.StatusNotFound)
+		}
+		apiErr := decodeApiError(t, response)
+		if apiErr.Code != ErrorNotFound || apiErr.Tag != "UnknownTag" {
+			t.Errorf("%s: got %+v", path, apiErr)
+		}
+	}
+	testHandler.cleanUp()
+}
+
+func TestApiV1InvalidRegisterValue(t *testing.T) {
+	testHandler := setupTestSuite()
+	routes := testHandler.handler.Routes()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPut, "/api/v1/register/"+valid_reg+"?value=abc", nil)
+	routes.ServeHTTP(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusBadRequest)
+	}
+	apiErr := decodeApiError(t, response)
+	if apiErr.Code != ErrorInvalidValue || apiErr.Address != valid_reg {
+		t.Errorf("Got %+v", apiErr)
+	}
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodDelete, "/api/v1/register/"+valid_reg, nil)
+	routes.ServeHTTP(response, request)
+	if response.Code != http.StatusMethodNotAllowed || response.Header().Get("Allow") != "GET, PUT" {
+		t.Errorf("Got %d allowing %q", response.Code, response.Header().Get("Allow"))
+	}
+	testHandler.cleanUp()
+}
+
+func TestApiV1PutGetTag(t *testing.T) {
+	testHandler := setupTestSuite()
+	routes := testHandler.handler.Routes()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPut, "/api/v1/tag/ValidTagF32?value=1.5", nil)
+	routes.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", response.Code, http.StatusOK)
+	}
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/api/v1/tag/ValidTagF32", nil)
+	routes.ServeHTTP(response, request)
+	var row types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&row)
+	if row.ValueOr(0) != 1.5 {
+		t.Errorf("Got %v, expected 1.5", row.Value)
+	}
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPut, "/api/v1/tag/UnknownTag?value=1", nil)
+	routes.ServeHTTP(response, request)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusNotFound)
+	}
+	testHandler.cleanUp()
+}
+
+func TestPutTagJsonBody(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPut, "/tag/ValidTagF32", strings.NewReader(`{"value": 2.5}`))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.GetTag(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d: %s", response.Code, http.StatusOK, response.Body.String())
+	}
+	row, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+	if row.ValueOr(0) != 2.5 {
+		t.Errorf("Got %v, expected 2.5", row.Value)
+	}
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPut, "/tag/ValidTagF32", strings.NewReader(`{"val": 2.5}`))
+	request.Header.Set("Content-Type", "application/json")
+	testHandler.handler.GetTag(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusBadRequest)
+	}
+	testHandler.cleanUp()
+}
+
+func postBatch(t *testing.T, h Handler, body string) (*httptest.ResponseRecorder, BatchResponse) {
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	h.Batch(response, request)
+	var batch BatchResponse
+	if err := json.NewDecoder(response.Body).Decode(&batch); err != nil {
+		t.Fatalf("Got %v decoding batch response", err)
+	}
+	return response, batch
+}
+
+func TestBatchReadWrite(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response, batch := postBatch(t, testHandler.handler, `{"items": [
+		{"tag": "ValidTagF32", "value": 3.5},
+		{"address": "`+valid_reg+`"},
+		{"tag": "UnknownTag", "value": 1}
+	]}`)
+	if response.Code != http.StatusOK || len(batch.Results) != 3 {
+		t.Fatalf("Got %d with %+v", response.Code, batch)
+	}
+	if batch.Results[0].Status != http.StatusOK || batch.Results[1].Result.ValueOr(0) != 3.5 {
+		t.Errorf("Got %+v", batch.Results[:2])
+	}
+	if batch.Results[2].Status != http.StatusNotFound || batch.Results[2].Error.Code != ErrorNotFound {
+		t.Errorf("Got %+v", batch.Results[2])
+	}
+	testHandler.cleanUp()
+}
+
+func TestBatchAtomicRollback(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response, batch := postBatch(t, testHandler.handler, `{"atomic": true, "items": [
+		{"tag": "ValidTagF32", "value": 3.5},
+		{"tag": "UnknownTag", "value": 1},
+		{"address": "`+valid_reg+`"}
+	]}`)
+	if response.Code != http.StatusUnprocessableEntity || len(batch.Results) != 3 {
+		t.Fatalf("Got %d with %+v", response.Code, batch)
+	}
+	if batch.Results[0].Error == nil || batch.Results[0].Error.Code != ErrorNotApplied || batch.Results[2].Error.Code != ErrorNotApplied {
+		t.Errorf("Got %+v", batch.Results)
+	}
+	row, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+	if row.ValueOr(0) == 3.5 {
+		t.Errorf("Got %v, expected the write to be rolled back", *row.Value)
+	}
+	testHandler.cleanUp()
+}
+
+func TestWriteWaitsForTransaction(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	// A transaction reading before it writes, as batches and Modbus writes do,
+	// while another write starts in between
+	written := make(chan error)
+	err := testHandler.handler.db.Transaction(func(tx *types.SqlDb) error {
+		if _, err := tx.GetRowByTag("ValidTagF32"); err != nil {
+			return err
+		}
+		go func() {
+			written <- testHandler.handler.db.SetTagValue("ValidTagF32_2", 2, testOrigin)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		return tx.SetTagValue("ValidTagF32", 1, testOrigin)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Errorf("Got %v, expected the write to wait for the transaction", err)
+	}
+	testHandler.cleanUp()
+}
+
+// checkSchema checks a decoded JSON value against an OpenAPI schema.  Objects
+// described by properties may not have any others so drift is caught both ways.
+func checkSchema(spec map[string]any, schema map[string]any, value any, at string) error {
+	if ref, found := schema["$ref"].(string); found {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, found := spec["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+		if !found {
+			return fmt.Errorf("%s: unknown schema %s", at, ref)
+		}
+		return checkSchema(spec, resolved, value, at)
+	}
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: unexpected null", at)
+	}
+	if allOf, found := schema["allOf"].([]any); found {
+		for _, sub := range allOf {
+			if err := checkSchema(spec, sub.(map[string]any), value, at); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch schema["type"] {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: %v is not a string", at, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, value)
+		}
+	case "number", "integer":
+		number, ok := value.(float64)
+		if !ok || (schema["type"] == "integer" && number != math.Trunc(number)) {
+			return fmt.Errorf("%s: %v is not a %s", at, value, schema["type"])
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, value)
+		}
+		for i, item := range items {
+			if err := checkSchema(spec, schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, value)
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, found := object[name]; !found {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+		for name, property := range object {
+			if propertySchema, found := properties[name]; found {
+				if err := checkSchema(spec, propertySchema.(map[string]any), property, at+"."+name); err != nil {
+					return err
+				}
+			} else if additional, found := schema["additionalProperties"].(map[string]any); found {
+				if err := checkSchema(spec, additional, property, at+"."+name); err != nil {
+					return err
+				}
+			} else {
+				return fmt.Errorf("%s: undocumented property %s", at, name)
+			}
+		}
+	}
+	return nil
+}
+
+// specOperation finds the documented operation for a request path
+func specOperation(spec map[string]any, method string, path string) (string, map[string]any) {
+	segments := strings.Split(path, "/")
+	for template, item := range spec["paths"].(map[string]any) {
+		templateSegments := strings.Split(template, "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+		matched := true
+		for i := range segments {
+			if !strings.HasPrefix(templateSegments[i], "{") && templateSegments[i] != segments[i] {
+				matched = false
+			}
+		}
+		if operation, found := item.(map[string]any)[strings.ToLower(method)]; matched && found {
+			return template, operation.(map[string]any)
+		}
+	}
+	return "", nil
+}
+
+func TestResponsesMatchOpenApi(t *testing.T) {
+	testHandler := setupTestSuite()
+	defer testHandler.cleanUp()
+	h := testHandler.handler
+	spec := h.OpenApi()
+
+	configData := types.ConfigurationData{ApiPort: testConfig.ApiPort, ModbusPort: testConfig.ModbusPort}
+	configData.Registers = sortedRegisters(h.registers.Get())
+	raw, _ := types.EncodeConfig(configData, types.FormatJson)
+	h.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	_ = os.WriteFile(h.ConfigPath, raw, 0o644)
+	routes := h.Routes()
+
+	backup := httptest.NewRecorder()
+	h.Backup(backup, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	snapshot := backup.Body.Bytes()
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/all_registers", ""},
+		{"GET", "/all_registers?sort=size", ""},
+		{"GET", "/groups/", ""},
+		{"GET", "/groups/Area1", ""},
+		{"GET", "/groups/Area9", ""},
+		{"GET", "/groups/Area1?limit=0", ""},
+		{"GET", "/registers.csv", ""},
+		{"GET", "/tag/ValidTagF32", ""},
+		{"GET", "/tag/NullTagF32", ""},
+		{"GET", "/tag/UnknownTag", ""},
+		{"GET", "/tag/ValidTagF32?wait=10ms", ""},
+		{"GET", "/tag/ValidTagF32?wait=soon", ""},
+		{"PUT", "/tag/ValidTagF32?value=1.5", ""},
+		{"PUT", "/tag/ValidTagF32", `{"value": 2}`},
+		{"PUT", "/tag/ValidTagF32?value=abc", ""},
+		{"PUT", "/tag/UnknownTag?value=1", ""},
+		{"DELETE", "/tag/ValidTagF32", ""},
+		{"GET", "/register/" + valid_reg, ""},
+		{"GET", "/register/999", ""},
+		{"PUT", "/register/" + valid_reg + "?value=3", ""},
+		{"PUT", "/register/" + valid_reg, `{}`},
+		{"PUT", "/register/999?value=3", ""},
+		{"GET", "/history/ValidTagF32", ""},
+		{"GET", "/history/ValidTagF32?limit=0", ""},
+		{"GET", "/history/UnknownTag", ""},
+		{"POST", "/batch", `{"items": [{"tag": "ValidTagF32", "value": 4}, {"tag": "UnknownTag"}, {}]}`},
+		{"POST", "/batch", `{"atomic": true, "items": [{"tag": "ValidTagF32", "value": 4}, {"tag": "UnknownTag"}]}`},
+		{"POST", "/batch", `{"items": 1}`},
+		{"GET", "/tags", ""},
+		{"POST", "/tags", `{"tag": "SpecTagU16", "address": "30", "datatype": "uint16"}`},
+		{"POST", "/tags", `{"tag": "SpecTagU16", "address": "31", "datatype": "uint16"}`},
+		{"POST", "/tags", `{"tag": "BadTag", "address": "32", "datatype": "uint8"}`},
+		{"GET", "/tags/SpecTagU16", ""},
+		{"GET", "/tags/UnknownTag", ""},
+		{"PATCH", "/tags/SpecTagU16", `{"description": "Spec"}`},
+		{"PATCH", "/tags/SpecTagU16", `{"tag": "ValidTagF32"}`},
+		{"PATCH", "/tags/SpecTagU16", `{"address": "4"}`},
+		{"PATCH", "/tags/UnknownTag", `{}`},
+		{"DELETE", "/tags/SpecTagU16", ""},
+		{"DELETE", "/tags/UnknownTag", ""},
+		{"GET", "/healthcheck", ""},
+		{"GET", "/admin/backup", ""},
+		{"POST", "/admin/restore", string(snapshot)},
+		{"POST", "/admin/restore", "not a database"},
+		{"POST", "/admin/reload", ""},
+		{"GET", "/audit?action=write", ""},
+		{"GET", "/audit?since=yesterday", ""},
+		{"GET", "/audit.csv?tag=Valid*", ""},
+		{"GET", "/audit.csv?limit=0", ""},
+		{"GET", "/openapi.json", ""},
+		{"GET", "/events?tag=Valid*", ""},
+		{"GET", "/events?tag=[", ""},
+		{"GET", "/ws", ""},
+		{"GET", "/unknown", ""},
+	}
+	covered := map[string]bool{}
+	for _, c := range cases {
+		name := c.method + " " + c.path
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(c.method, ApiPrefix+c.path, strings.NewReader(c.body))
+		if strings.HasPrefix(c.path, "/events") {
+			// Streams only end when the client goes away
+			ctx, cancel := context.WithCancel(request.Context())
+			cancel()
+			request = request.WithContext(ctx)
+		}
+		routes.ServeHTTP(response, request)
+
+		path, _, _ := strings.Cut(c.path, "?")
+		template, operation := specOperation(spec, c.method, path)
+		responses := map[string]any{"default": map[string]any{"content": map[string]any{"application/json": map[string]any{
+			"schema": map[string]any{"$ref": "#/components/schemas/ErrorResponse"}}}}}
+		if operation != nil {
+			covered[c.method+" "+template] = true
+			responses = operation["responses"].(map[string]any)
+		}
+		documented, found := responses[strconv.Itoa(response.Code)].(map[string]any)
+		if !found {
+			documented = responses["default"].(map[string]any)
+		}
+
+		contents, _ := documented["content"].(map[string]any)
+		if contents == nil {
+			if response.Body.Len() > 0 {
+				t.Errorf("%s: %d has an undocumented body %q", name, response.Code, response.Body.String())
+			}
+			continue
+		}
+		jsonContent, isJson := contents["application/json"].(map[string]any)
+		if !isJson {
+			for contentType := range contents {
+				if !strings.HasPrefix(response.Header().Get("Content-Type"), contentType) {
+					t.Errorf("%s: got content type %q, expected %q", name, response.Header().Get("Content-Type"), contentType)
+				}
+			}
+			continue
+		}
+		var body any
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %d body is not JSON: %q", name, response.Code, response.Body.String())
+			continue
+		}
+		if err := checkSchema(spec, jsonContent["schema"].(map[string]any), body, "body"); err != nil {
+			t.Errorf("%s: %d: %v", name, response.Code, err)
+		}
+	}
+
+	for path, item := range spec["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			if !covered[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s isn't exercised", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// readEvents reads Server-Sent Events until count data messages have arrived
+func readEvents(t *testing.T, reader *bufio.Reader, count int) (ids []string, changes []types.ValueChange, events []string) {
+	id := ""
+	for len(changes) < count {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Got %v reading events", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		case strings.HasPrefix(line, "data: ") && id != "":
+			var change types.ValueChange
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change); err != nil {
+				t.Fatalf("Got %v decoding %q", err, line)
+			}
+			ids = append(ids, id)
+			changes = append(changes, change)
+			id = ""
+		}
+	}
+	return ids, changes, events
+}
+
+func openEvents(t *testing.T, server *httptest.Server, query string, lastEventId string) (*http.Response, *bufio.Reader) {
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/events"+query, nil)
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", response.StatusCode, http.StatusOK)
+	}
+	return response, bufio.NewReader(response.Body)
+}
+
+func TestEventsApiAndModbusWrites(t *testing.T) {
+	testHandler := setupTestSuite()
+	server := httptest.NewServer(testHandler.handler.Routes())
+	defer server.Close()
+
+	response, reader := openEvents(t, server, "?tag=Valid*", "")
+	defer response.Body.Close()
+
+	// Not matched by the filter
+	_ = testHandler.handler.db.SetTagValue("NullTagF32", 1, testOrigin)
+	err := testHandler.mb_client.WriteFloat32(4, 5.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = testHandler.handler.db.SetTagValue("ValidTagF32", 6.5, testOrigin)
+
+	_, changes, _ := readEvents(t, reader, 2)
+	if changes[0].Tag != "ValidTagF32" || changes[0].Value != 5.5 || changes[0].Source != types.SourceModbus {
+		t.Errorf("Got %+v", changes[0])
+	}
+	if changes[1].Tag != "ValidTagF32" || changes[1].Value != 6.5 {
+		t.Errorf("Got %+v", changes[1])
+	}
+	testHandler.cleanUp()
+}
+
+func TestEventsModbusBitWrites(t *testing.T) {
+	testHandler := setupTestSuite()
+	defer testHandler.cleanUp()
+	server := httptest.NewServer(testHandler.handler.Routes())
+	defer server.Close()
+	if err := testHandler.mb_client.WriteRegister(10, 0b0001); err != nil {
+		t.Fatal(err)
+	}
+
+	response, reader := openEvents(t, server, "?tag=SampleTagDigital*", "")
+	defer response.Body.Close()
+	// Writing the register as a whole changes bits 0, 1 and 2, then nothing,
+	// then only bit 3
+	for _, value := range []uint16{0b0110, 0b0110, 0b1110} {
+		if err := testHandler.mb_client.WriteRegister(10, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, changes, _ := readEvents(t, reader, 4)
+	first := changes[:3]
+	slices.SortFunc(first, func(a, b types.ValueChange) int { return strings.Compare(a.Tag, b.Tag) })
+	expected := []struct {
+		tag   string
+		value float64
+	}{{"SampleTagDigital0", 0}, {"SampleTagDigital1", 1}, {"SampleTagDigital2", 1}, {"SampleTagDigital3", 1}}
+	for i, change := range append(first, changes[3]) {
+		if change.Tag != expected[i].tag || change.Value != expected[i].value || change.Source != types.SourceModbus {
+			t.Errorf("Got %+v, expected %s = %v", change, expected[i].tag, expected[i].value)
+		}
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	testHandler := setupTestSuite()
+	server := httptest.NewServer(testHandler.handler.Routes())
+	defer server.Close()
+
+	lastId := strconv.FormatUint(testHandler.handler.db.Changes.LastId(), 10)
+	_ = testHandler.handler.db.SetTagValue("ValidTagF32", 1, testOrigin)
+	_ = testHandler.handler.db.SetTagValue("ValidTagF32", 2, testOrigin)
+
+	response, reader := openEvents(t, server, "", lastId)
+	defer response.Body.Close()
+	ids, changes, events := readEvents(t, reader, 2)
+	if changes[0].Value != 1 || changes[1].Value != 2 || len(events) != 0 {
+		t.Errorf("Got %v %+v %v", ids, changes, events)
+	}
+	testHandler.cleanUp()
+}
+
+func readWsMessage(t *testing.T, conn *websocket.Conn) WsMessage {
+	var message WsMessage
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatalf("Got %v reading WebSocket", err)
+	}
+	return message
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	testHandler := setupTestSuite()
+	server := httptest.NewServer(testHandler.handler.Routes())
+	defer server.Close()
+
+	for origin, allowed := range map[string]bool{
+		"":                     true,
+		server.URL:             true,
+		"https://evil.example": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/ws", header)
+		if (err == nil) != allowed {
+			t.Errorf("%q: got %v, expected allowed %v", origin, err, allowed)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	testHandler.cleanUp()
+}
+
+func TestWebSocketSubscribeDeadbandWrite(t *testing.T) {
+	testHandler := setupTestSuite()
+	server := httptest.NewServer(testHandler.handler.Routes())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.WriteJSON(WsRequest{Type: WsSubscribe, Id: "sub", Tags: []string{"ValidTagF32"}, Deadband: 1})
+	if message := readWsMessage(t, conn); message.Type != WsResult || message.Id != "sub" || message.Status != http.StatusOK {
+		t.Fatalf("Got %+v", message)
+	}
+	message := readWsMessage(t, conn)
+	if message.Type != WsValue || message.Result.Tag != "ValidTagF32" || message.Result.ValueOr(0) != 100 {
+		t.Fatalf("Got %+v", message)
+	}
+
+	// Within the deadband of the last value sent, then outside it
+	_ = testHandler.mb_client.WriteFloat32(4, 100.5)
+	_ = testHandler.mb_client.WriteFloat32(4, 102)
+	message = readWsMessage(t, conn)
+	if message.Type != WsChange || message.Change.Value != 102 || message.Change.Source != types.SourceModbus {
+		t.Errorf("Got %+v", message)
+	}
+
+	_ = conn.WriteJSON(WsRequest{Type: WsWrite, Id: "write", Tag: "ValidTagF32", Value: &initialValue})
+	// The change and the result of the write may arrive in either order
+	received := map[string]WsMessage{}
+	for i := 0; i < 2; i++ {
+		message = readWsMessage(t, conn)
+		received[message.Type] = message
+	}
+	if result := received[WsResult]; result.Id != "write" || result.Result == nil || result.Result.ValueOr(0) != initialValue {
+		t.Errorf("Got %+v", result)
+	}
+	if change := received[WsChange]; change.Change == nil || change.Change.Value != initialValue {
+		t.Errorf("Got %+v", change)
+	}
+
+	_ = conn.WriteJSON(WsRequest{Type: WsWrite, Id: "unknown", Tag: "UnknownTag", Value: &initialValue})
+	if message := readWsMessage(t, conn); message.Status != http.StatusNotFound || message.Error.Code != ErrorNotFound {
+		t.Errorf("Got %+v", message)
+	}
+	testHandler.cleanUp()
+}
+
+func TestWebSocketSubscribeModbusBitWrite(t *testing.T) {
+	testHandler := setupTestSuite()
+	defer testHandler.cleanUp()
+	server := httptest.NewServer(testHandler.handler.Routes())
+	defer server.Close()
+	if err := testHandler.mb_client.WriteRegister(10, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.WriteJSON(WsRequest{Type: WsSubscribe, Id: "sub", Tags: []string{"SampleTagDigital2"}})
+	if message := readWsMessage(t, conn); message.Type != WsResult || message.Status != http.StatusOK {
+		t.Fatalf("Got %+v", message)
+	}
+	if message := readWsMessage(t, conn); message.Type != WsValue || message.Result.Tag != "SampleTagDigital2" || message.Result.ValueOr(1) != 0 {
+		t.Fatalf("Got %+v", message)
+	}
+
+	// Leaving bit 2 alone sends nothing, setting it sends its change
+	_ = testHandler.mb_client.WriteRegister(10, 0b0011)
+	_ = testHandler.mb_client.WriteRegister(10, 0b0100)
+	message := readWsMessage(t, conn)
+	if message.Type != WsChange || message.Change.Tag != "SampleTagDigital2" || message.Change.Value != 1 || message.Change.Source != types.SourceModbus {
+		t.Errorf("Got %+v", message)
+	}
+}
+
+func TestWaitForTagChange(t *testing.T) {
+	testHandler := setupTestSuite()
+	current, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/tag/ValidTagF32?wait=5s&since_version="+strconv.FormatInt(current.Version, 10), nil)
+		testHandler.handler.GetTag(response, request)
+		done <- response
+	}()
+
+	// Changes to other tags don't end the wait
+	time.Sleep(50 * time.Millisecond)
+	_ = testHandler.handler.db.SetTagValue("NullTagF32", 1, testOrigin)
+	err := testHandler.mb_client.WriteFloat32(4, 7.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case response := <-done:
+		var row types.ModbusResponse
+		_ = json.NewDecoder(response.Body).Decode(&row)
+		if response.Code != http.StatusOK || row.ValueOr(0) != 7.5 {
+			t.Errorf("Got %d %+v", response.Code, row)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't end on a change")
+	}
+	testHandler.cleanUp()
+}
+
+func TestWaitForBitTagChange(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/tag/SampleTagDigital3?wait=5s", nil)
+		testHandler.handler.GetTag(response, request)
+		done <- response
+	}()
+
+	// Modbus writes the whole register rather than the bit's own row
+	time.Sleep(50 * time.Millisecond)
+	regNum, _ := strconv.Atoi(digital_reg)
+	err := testHandler.mb_client.WriteRegister(uint16(regNum), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case response := <-done:
+		var row types.ModbusResponse
+		_ = json.NewDecoder(response.Body).Decode(&row)
+		if response.Code != http.StatusOK || row.ValueOr(0) != 1 {
+			t.Errorf("Got %d %+v", response.Code, row)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't end on a register write")
+	}
+	testHandler.cleanUp()
+}
+
+func TestWaitForTagTimeout(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/tag/ValidTagF32?wait=50ms", nil)
+	testHandler.handler.GetTag(response, request)
+	if response.Code != http.StatusNoContent || response.Body.Len() != 0 {
+		t.Errorf("Got %d %q, expected %d", response.Code, response.Body.String(), http.StatusNoContent)
+	}
+
+	// The current last_update or version waits, an older one is answered straight away
+	current, _ := testHandler.handler.db.GetRowByTag("ValidTagF32")
+	for query, expected := range map[string]int{
+		"since=" + url.QueryEscape(current.LastUpdate):              http.StatusNoContent,
+		"since=2000-01-01+00:00:00":                                 http.StatusOK,
+		"since_version=" + strconv.FormatInt(current.Version, 10):   http.StatusNoContent,
+		"since_version=" + strconv.FormatInt(current.Version-1, 10): http.StatusOK,
+		"since_version=2000-01-01":                                  http.StatusBadRequest,
+	} {
+		response = httptest.NewRecorder()
+		request, _ = http.NewRequest(http.MethodGet, "/tag/ValidTagF32?wait=50ms&"+query, nil)
+		testHandler.handler.GetTag(response, request)
+		if response.Code != expected {
+			t.Errorf("%s: got %d, expected %d", query, response.Code, expected)
+		}
+	}
+	testHandler.cleanUp()
+}
+
+func TestGetRegistersQuery(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	get := func(query string) ([]string, string, int) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/all_registers?"+query, nil)
+		testHandler.handler.GetRegisters(response, request)
+		var registers []types.ModbusResponse
+		_ = json.NewDecoder(response.Body).Decode(&registers)
+		tags := []string{}
+		for _, register := range registers {
+			tags = append(tags, register.Tag)
+		}
+		return tags, response.Header().Get("X-Total-Count"), response.Code
+	}
+
+	tests := []struct {
+		query string
+		tags  []string
+		total string
+	}{
+		{"tag=ValidTag*", []string{"ValidTagF32", "ValidTagF32_2"}, "2"},
+		{"tag=ValidTagF32&tag=Stale*", []string{"ValidTagF32", "StaleTagU16"}, "2"},
+		{"description=Digital*&sort=-tag", []string{"SampleTagDigital3", "SampleTagDigital2", "SampleTagDigital11_0", "SampleTagDigital1", "SampleTagDigital0"}, "5"},
+		{"datatype=uint16", []string{"StaleTagU16", "InitialTagU16"}, "2"},
+		{"group=Area1", []string{"ValidTagF32", "ValidTagF32_2"}, "2"},
+		{"min_address=10&max_address=16", []string{"SampleTagDigital0", "SampleTagDigital1", "SampleTagDigital2", "SampleTagDigital3", "SampleTagDigital11_0", "SampleTagF32"}, "6"},
+		{"sort=-value&limit=2", []string{"SampleTagF32", "ValidTagF32"}, "11"},
+		{"limit=3&page=2", []string{"SampleTagDigital0", "SampleTagDigital1", "SampleTagDigital2"}, "11"},
+		{"limit=5&page=9", []string{}, "11"},
+	}
+	for _, test := range tests {
+		tags, total, code := get(test.query)
+		if code != http.StatusOK || !slices.Equal(tags, test.tags) || total != test.total {
+			t.Errorf("%s: got %d %v of %s, expected %v of %s", test.query, code, tags, total, test.tags, test.total)
+		}
+	}
+
+	// Generated generic rows aren't configured tags
+	tags, _, _ := get("")
+	if len(tags) != len(testConfig.Registers) {
+		t.Errorf("Got %d registers, expected %d", len(tags), len(testConfig.Registers))
+	}
+
+	for _, query := range []string{"sort=size", "limit=0", "page=2", "limit=2&page=0", "min_address=ten", "tag=["} {
+		if _, _, code := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, expected %d", query, code, http.StatusBadRequest)
+		}
+	}
+	testHandler.cleanUp()
+}
+
+func TestGetRegistersBitValues(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/all_registers?tag=SampleTagDigital*", nil)
+	testHandler.handler.GetRegisters(response, request)
+	var registers []types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&registers)
+	for _, register := range registers {
+		single, _ := testHandler.handler.db.GetRowByTag(register.Tag)
+		if register.ValueOr(-1) != single.ValueOr(-1) || register.Quality != single.Quality {
+			t.Errorf("%s: got %v %s, expected %v %s", register.Tag, register.ValueOr(-1), register.Quality, single.ValueOr(-1), single.Quality)
+		}
+	}
+	testHandler.cleanUp()
+}
+
+func TestGetGroup(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	get := func(path string) (Group, int) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		testHandler.handler.GetGroup(response, request)
+		var group Group
+		_ = json.NewDecoder(response.Body).Decode(&group)
+		return group, response.Code
+	}
+	tagsOf := func(group Group) []string {
+		tags := []string{}
+		for _, tag := range group.Tags {
+			tags = append(tags, tag.Tag)
+		}
+		return tags
+	}
+
+	root, code := get("/groups/")
+	expected := []GroupSummary{{"Area1", "Area1", 2}, {"Area2", "Area2", 1}}
+	if code != http.StatusOK || !slices.Equal(root.Groups, expected) || len(root.Tags) != len(testConfig.Registers) {
+		t.Errorf("Got %d %+v with %d tags", code, root.Groups, len(root.Tags))
+	}
+
+	area, code := get("/groups/Area1")
+	expected = []GroupSummary{{"Unit1", "Area1/Unit1", 1}, {"Unit2", "Area1/Unit2", 1}}
+	if code != http.StatusOK || !slices.Equal(area.Groups, expected) || !slices.Equal(tagsOf(area), []string{"ValidTagF32", "ValidTagF32_2"}) {
+		t.Errorf("Got %d %+v %v", code, area.Groups, tagsOf(area))
+	}
+
+	unit, code := get("/groups/Area1/Unit2/")
+	if code != http.StatusOK || unit.Path != "Area1/Unit2" || len(unit.Groups) != 0 || !slices.Equal(tagsOf(unit), []string{"ValidTagF32_2"}) {
+		t.Errorf("Got %d %+v", code, unit)
+	}
+	if unit.Tags[0].Path != "Area1/Unit2" || unit.Tags[0].ValueOr(0) != 100 {
+		t.Errorf("Got %+v", unit.Tags[0])
+	}
+
+	// A group name is only matched whole
+	if _, code := get("/groups/Area"); code != http.StatusNotFound {
+		t.Errorf("Got %d, expected %d", code, http.StatusNotFound)
+	}
+	if _, code := get("/groups/Area1/../Area2"); code != http.StatusBadRequest {
+		t.Errorf("Got %d, expected %d", code, http.StatusBadRequest)
+	}
+	testHandler.cleanUp()
+}
+
+func TestTagMetadataEnforced(t *testing.T) {
+	testHandler := setupTestSuite()
+	db := testHandler.handler.db
+	minimum, maximum, initial := 0.0, 100.0, 12.0
+	err := db.UpdateTableTags(map[types.InstrumentTag]types.ModbusTag{
+		"LimitedTagU16": {Tag: "LimitedTagU16", Address: "22", DataType: "uint16", Units: "%", Min: &minimum, Max: &maximum,
+			Properties: map[string]string{"loop": "FIC-22"}},
+		"ReadOnlyTagU16":  {Tag: "ReadOnlyTagU16", Address: "23", DataType: "uint16", Access: types.AccessReadOnly, InitialValue: &initial},
+		"WriteOnlyTagU16": {Tag: "WriteOnlyTagU16", Address: "24", DataType: "uint16", Access: types.AccessWriteOnly},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(path string) (int, ErrorResponse) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodPut, path, nil)
+		testHandler.handler.GetTag(response, request)
+		var body ErrorResponse
+		_ = json.NewDecoder(response.Body).Decode(&body)
+		return response.Code, body
+	}
+	if code, body := put("/tag/LimitedTagU16?value=150"); code != http.StatusBadRequest || body.Error.Code != ErrorInvalidValue {
+		t.Errorf("Got %d %+v, expected %d", code, body, http.StatusBadRequest)
+	}
+	if code, _ := put("/tag/LimitedTagU16?value=50"); code != http.StatusOK {
+		t.Errorf("Got %d, expected %d", code, http.StatusOK)
+	}
+	if code, body := put("/tag/ReadOnlyTagU16?value=5"); code != http.StatusForbidden || body.Error.Code != ErrorReadOnly {
+		t.Errorf("Got %d %+v, expected %d", code, body, http.StatusForbidden)
+	}
+	if code, _ := put("/tag/WriteOnlyTagU16?value=5"); code != http.StatusOK {
+		t.Errorf("Got %d, expected %d", code, http.StatusOK)
+	}
+
+	limited, _ := db.GetRowByTag("LimitedTagU16")
+	if limited.Units != "%" || *limited.Min != 0 || *limited.Max != 100 || limited.Access != types.AccessReadWrite ||
+		limited.Properties["loop"] != "FIC-22" || limited.ValueOr(0) != 50 {
+		t.Errorf("Got %+v", limited)
+	}
+	// The configured initial value is written despite being read-only
+	if readOnly, _ := db.GetRowByTag("ReadOnlyTagU16"); readOnly.ValueOr(0) != initial {
+		t.Errorf("Got %+v, expected %v", readOnly, initial)
+	}
+	if writeOnly, _ := db.GetRowByTag("WriteOnlyTagU16"); writeOnly.Value != nil || !writeOnly.Initialized {
+		t.Errorf("Got %+v, expected a hidden value", writeOnly)
+	}
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/history/WriteOnlyTagU16", nil)
+	testHandler.handler.GetHistory(response, request)
+	if response.Code != http.StatusForbidden {
+		t.Errorf("Got %d, expected %d for a write-only tag's history", response.Code, http.StatusForbidden)
+	}
+
+	mbClient := testHandler.mb_client
+	if err := mbClient.WriteRegister(23, 5); err == nil {
+		t.Error("Wrote a read-only register over Modbus")
+	}
+	if _, err := mbClient.ReadRegister(24, modbus.HOLDING_REGISTER); err == nil {
+		t.Error("Read a write-only register over Modbus")
+	}
+	// The out of range value refuses the whole write
+	if err := mbClient.WriteRegisters(21, []uint16{5, 150}); err == nil {
+		t.Error("Wrote a value above max over Modbus")
+	}
+	if value, _ := mbClient.ReadRegister(21, modbus.HOLDING_REGISTER); value != uint16(initialValue) {
+		t.Errorf("Got %d, expected %v", value, initialValue)
+	}
+	if err := mbClient.WriteRegisters(21, []uint16{5, 60}); err != nil {
+		t.Error(err)
+	}
+	if limited, _ := db.GetRowByTag("LimitedTagU16"); limited.ValueOr(0) != 60 {
+		t.Errorf("Got %+v, expected 60", limited)
+	}
+	testHandler.cleanUp()
+}
+
+func TestBitTagMetadataEnforced(t *testing.T) {
+	testHandler := setupTestSuite()
+	db := testHandler.handler.db
+	zero := 0.0
+	err := db.UpdateTableTags(map[types.InstrumentTag]types.ModbusTag{
+		"ReadOnlyBit":  {Tag: "ReadOnlyBit", Address: "25_0", DataType: "digital", Access: types.AccessReadOnly},
+		"LimitedBit":   {Tag: "LimitedBit", Address: "25_1", DataType: "digital", Max: &zero},
+		"WriteOnlyBit": {Tag: "WriteOnlyBit", Address: "26_0", DataType: "digital", Access: types.AccessWriteOnly},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing the whole register is checked against every bit sharing it
+	mbClient := testHandler.mb_client
+	if err := mbClient.WriteRegister(25, 0b01); err == nil {
+		t.Error("Changed a read-only bit over Modbus")
+	}
+	if err := mbClient.WriteRegister(25, 0b10); err == nil {
+		t.Error("Wrote a bit above max over Modbus")
+	}
+	if err := mbClient.WriteRegister(25, 0b100); err != nil {
+		t.Error(err)
+	}
+	if err := mbClient.WriteRegister(26, 1); err != nil {
+		t.Error(err)
+	}
+	if _, err := mbClient.ReadRegister(26, modbus.HOLDING_REGISTER); err == nil {
+		t.Error("Read a register holding a write-only bit over Modbus")
+	}
+	testHandler.cleanUp()
+}
+
+func TestTagETagIfMatch(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	get := func() string {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/tag/ValidTagF32", nil)
+		testHandler.handler.GetTag(response, request)
+		return response.Header().Get("ETag")
+	}
+	put := func(value string, ifMatch string) (int, string) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodPut, "/tag/ValidTagF32?value="+value, nil)
+		if ifMatch != "" {
+			request.Header.Set("If-Match", ifMatch)
+		}
+		testHandler.handler.GetTag(response, request)
+		return response.Code, response.Header().Get("ETag")
+	}
+
+	first := get()
+	if first == "" {
+		t.Fatal("No ETag")
+	}
+	code, second := put("1", first)
+	if code != http.StatusOK || second == first || second != get() {
+		t.Errorf("Got %d %s, expected a new ETag after %s", code, second, first)
+	}
+	// The first operator's change was overwritten meanwhile
+	if code, _ := put("2", first); code != http.StatusPreconditionFailed {
+		t.Errorf("Got %d, expected %d", code, http.StatusPreconditionFailed)
+	}
+	if code, _ := put("2", `"999", `+second); code != http.StatusOK {
+		t.Errorf("Got %d, expected %d", code, http.StatusOK)
+	}
+	if code, _ := put("3", "W/"+get()); code != http.StatusPreconditionFailed {
+		t.Errorf("Got %d, expected %d for a weak ETag", code, http.StatusPreconditionFailed)
+	}
+	if code, _ := put("3", "*"); code != http.StatusOK {
+		t.Errorf("Got %d, expected %d", code, http.StatusOK)
+	}
+	if code, _ := put("3", "yesterday"); code != http.StatusBadRequest {
+		t.Errorf("Got %d, expected %d", code, http.StatusBadRequest)
+	}
+
+	// Only one of several writers holding the same ETag wins
+	current := get()
+	codes := make(chan int)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			code, _ := put(strconv.Itoa(10+i), current)
+			codes <- code
+		}(i)
+	}
+	won := 0
+	for i := 0; i < 5; i++ {
+		switch code := <-codes; code {
+		case http.StatusOK:
+			won++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("Got %d", code)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d writers won, expected 1", won)
+	}
+	testHandler.cleanUp()
+}
+
+func TestRegisterETagIfMatch(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/register/"+valid_reg, nil)
+	testHandler.handler.GetRegister(response, request)
+	current := response.Header().Get("ETag")
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPut, "/register/"+valid_reg+"?value=5", nil)
+	request.Header.Set("If-Match", current)
+	testHandler.handler.GetRegister(response, request)
+	var row types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&row)
+	if response.Code != http.StatusOK || response.Header().Get("ETag") != etag(row) || etag(row) == current {
+		t.Errorf("Got %d %s for %+v", response.Code, response.Header().Get("ETag"), row)
+	}
+
+	// Modbus writes change the version too
+	_ = testHandler.mb_client.WriteFloat32(4, 6)
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPut, "/register/"+valid_reg+"?value=7", nil)
+	request.Header.Set("If-Match", etag(row))
+	testHandler.handler.GetRegister(response, request)
+	if response.Code != http.StatusPreconditionFailed {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusPreconditionFailed)
+	}
+	testHandler.cleanUp()
+}
+
+func TestBitTagETag(t *testing.T) {
+	testHandler := setupTestSuite()
+
+	get := func() (string, types.ModbusResponse) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/tag/SampleTagDigital3", nil)
+		testHandler.handler.GetTag(response, request)
+		var row types.ModbusResponse
+		_ = json.NewDecoder(response.Body).Decode(&row)
+		return response.Header().Get("ETag"), row
+	}
+	current, _ := get()
+
+	// A Modbus write of the whole register changes the bit's version
+	regNum, _ := strconv.Atoi(digital_reg)
+	if err := testHandler.mb_client.WriteRegister(uint16(regNum), 8); err != nil {
+		t.Fatal(err)
+	}
+	changed, row := get()
+	if changed == current || changed != etag(row) || row.ValueOr(0) != 1 {
+		t.Errorf("Got %s for %+v, was %s", changed, row, current)
+	}
+	rows, _, _ := testHandler.handler.db.QueryRows(types.RegisterQuery{Tags: []string{"SampleTagDigital3"}})
+	if len(rows) != 1 || etag(rows[0]) != changed {
+		t.Errorf("Got %+v, expected version %s", rows, changed)
+	}
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPut, "/tag/SampleTagDigital3?value=0", nil)
+	request.Header.Set("If-Match", current)
+	testHandler.handler.GetTag(response, request)
+	if response.Code != http.StatusPreconditionFailed {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusPreconditionFailed)
+	}
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPut, "/tag/SampleTagDigital3?value=0", nil)
+	request.Header.Set("If-Match", changed)
+	testHandler.handler.GetTag(response, request)
+	if response.Code != http.StatusOK {
+		t.Errorf("Got %d, expected %d", response.Code, http.StatusOK)
+	}
+	testHandler.cleanUp()
+}
+
+func TestTokenAuth(t *testing.T) {
+	testHandler := setupTestSuite()
+	defer testHandler.cleanUp()
+	h := testHandler.handler
+	h.auth.Store(&types.AuthConfig{
+		Tokens: []types.ApiToken{
+			{Name: "viewer", Token: "viewer-secret", Role: types.RoleViewer},
+			{Name: "area1", Token: "area1-secret", Groups: map[string]string{"Area1": types.RoleOperator, "Area2": types.RoleViewer}},
+			{Name: "admin", Token: "admin-secret", Role: types.RoleAdmin},
+		},
+		AllowedOrigins: []string{"https://ui.example"},
+	})
+	routes := h.Routes()
+
+	for _, c := range []struct {
+		method   string
+		path     string
+		header   string
+		token    string
+		expected int
+	}{
+		{"GET", "/tag/ValidTagF32", "", "", http.StatusUnauthorized},
+		{"GET", "/tag/ValidTagF32", "Authorization", "Bearer wrong", http.StatusUnauthorized},
+		{"GET", "/healthcheck", "", "", http.StatusUnauthorized},
+		{"GET", "/tag/ValidTagF32", "Authorization", "Bearer viewer-secret", http.StatusOK},
+		{"PUT", "/tag/ValidTagF32?value=1", "Authorization", "Bearer viewer-secret", http.StatusForbidden},
+		{"GET", "/admin/backup", "Authorization", "Bearer viewer-secret", http.StatusForbidden},
+		{"PUT", "/tag/ValidTagF32?value=1", "X-API-Key", "area1-secret", http.StatusOK},
+		{"PUT", "/register/" + valid_reg_next + "?value=1", "X-API-Key", "area1-secret", http.StatusOK},
+		{"PUT", "/tag/StaleTagU16?value=1", "X-API-Key", "area1-secret", http.StatusForbidden},
+		{"GET", "/tag/StaleTagU16", "X-API-Key", "area1-secret", http.StatusOK},
+		{"GET", "/tag/SampleTagF32", "X-API-Key", "area1-secret", http.StatusForbidden},
+		{"GET", "/history/SampleTagF32", "X-API-Key", "area1-secret", http.StatusForbidden},
+		{"POST", "/tags", "X-API-Key", "area1-secret", http.StatusForbidden},
+		{"GET", "/admin/backup", "X-API-Key", "area1-secret", http.StatusForbidden},
+		{"GET", "/admin/backup?access_token=admin-secret", "", "", http.StatusUnauthorized},
+		{"GET", "/tag/ValidTagF32?access_token=viewer-secret", "", "", http.StatusUnauthorized},
+		{"GET", "/events?access_token=wrong", "", "", http.StatusUnauthorized},
+	} {
+		name := c.method + " " + c.path + " " + c.token
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(c.method, ApiPrefix+c.path, nil)
+		if c.header != "" {
+			request.Header.Set(c.header, c.token)
+		}
+		routes.ServeHTTP(response, request)
+		if response.Code != c.expected {
+			t.Errorf("%s: got %d, expected %d: %s", name, response.Code, c.expected, response.Body.String())
+		}
+		if response.Code == http.StatusUnauthorized && response.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate", name)
+		}
+	}
+
+	// Listings leave out the groups a token can't view
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/all_registers", nil)
+	request.Header.Set("Authorization", "Bearer area1-secret")
+	routes.ServeHTTP(response, request)
+	var rows []types.ModbusResponse
+	_ = json.NewDecoder(response.Body).Decode(&rows)
+	if len(rows) != 3 || response.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("Got %d rows of %s, expected the 3 in Area1 and Area2", len(rows), response.Header().Get("X-Total-Count"))
+	}
+
+	// Batch items are checked one by one
+	response = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/batch", strings.NewReader(`{"items": [{"tag": "ValidTagF32", "value": 2}, {"tag": "StaleTagU16", "value": 2}]}`))
+	request.Header.Set("Authorization", "Bearer area1-secret")
+	request.Header.Set("Content-Type", "application/json")
+	routes.ServeHTTP(response, request)
+	var batch BatchResponse
+	_ = json.NewDecoder(response.Body).Decode(&batch)
+	if len(batch.Results) != 2 || batch.Results[0].Status != http.StatusOK || batch.Results[1].Status != http.StatusForbidden {
+		t.Errorf("Got %+v", batch.Results)
+	}
+
+	// Browser event streams and WebSockets can't set headers, so they may give
+	// the token in the query
+	server := httptest.NewServer(routes)
+	defer server.Close()
+	events, err := http.Get(server.URL + ApiPrefix + "/events?access_token=viewer-secret")
+	if err != nil || events.StatusCode != http.StatusOK {
+		t.Errorf("Got %v %v for events with a query token", events, err)
+	} else {
+		events.Body.Close()
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+ApiPrefix+"/ws?access_token=viewer-secret", nil)
+	if err != nil {
+		t.Errorf("Got %v for a WebSocket with a query token", err)
+	} else {
+		conn.Close()
+	}
+
+	// Healthchecks can be left public
+	auth := h.Auth()
+	auth.PublicHealthcheck = true
+	h.auth.Store(&auth)
+	response = httptest.NewRecorder()
+	routes.ServeHTTP(response, httptest.NewRequest("GET", "/healthcheck", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("Got %d for a public healthcheck", response.Code)
+	}
+}
+
+func TestCorsOrigins(t *testing.T) {
+	testHandler := setupTestSuite()
+	defer testHandler.cleanUp()
+	h := testHandler.handler
+	routes := h.Routes()
+
+	// Without tokens any origin may read the API
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/tag/ValidTagF32", nil)
+	request.Header.Set("Origin", "https://anywhere.example")
+	routes.ServeHTTP(response, request)
+	if response.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Got %q", response.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// but writes need an allowed origin, so a foreign page's preflight isn't answered
+	response = httptest.NewRecorder()
+	request = httptest.NewRequest("OPTIONS", "/tag/ValidTagF32", nil)
+	request.Header.Set("Origin", "https://anywhere.example")
+	request.Header.Set("Access-Control-Request-Method", "PUT")
+	routes.ServeHTTP(response, request)
+	for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods", "Access-Control-Allow-Headers"} {
+		if response.Header().Get(header) != "" {
+			t.Errorf("Got %s %q for a foreign preflight", header, response.Header().Get(header))
+		}
+	}
+
+	// The API's own origin is always allowed
+	response = httptest.NewRecorder()
+	request = httptest.NewRequest("OPTIONS", "http://api.example:8081/tag/ValidTagF32", nil)
+	request.Header.Set("Origin", "http://api.example:8081")
+	request.Header.Set("Access-Control-Request-Method", "PUT")
+	routes.ServeHTTP(response, request)
+	if response.Header().Get("Access-Control-Allow-Origin") != "http://api.example:8081" {
+		t.Errorf("Got %q for the API's own origin", response.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// A form post needs no preflight, so a foreign page's is refused outright
+	before, _ := h.db.GetRowByTag("ValidTagF32")
+	response = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/batch", strings.NewReader(`{"items": [{"tag": "ValidTagF32", "value": 7}]}`))
+	request.Header.Set("Origin", "http://evil.example")
+	request.Header.Set("Content-Type", "text/plain")
+	routes.ServeHTTP(response, request)
+	if after, _ := h.db.GetRowByTag("ValidTagF32"); response.Code != http.StatusForbidden || *after.Value != *before.Value {
+		t.Errorf("Got %d and value %v for a foreign form post", response.Code, *after.Value)
+	}
+	// and bodies that aren't JSON are refused from anywhere
+	response = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/batch", strings.NewReader(`{"items": [{"tag": "ValidTagF32", "value": 7}]}`))
+	request.Header.Set("Content-Type", "text/plain")
+	routes.ServeHTTP(response, request)
+	if after, _ := h.db.GetRowByTag("ValidTagF32"); response.Code != http.StatusUnsupportedMediaType || *after.Value != *before.Value {
+		t.Errorf("Got %d and value %v for a text/plain body", response.Code, *after.Value)
+	}
+	response = httptest.NewRecorder()
+	request = httptest.NewRequest("PUT", "/tag/ValidTagF32", strings.NewReader(`{"value": 7}`))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	routes.ServeHTTP(response, request)
+	if response.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Got %d for a form encoded write", response.Code)
+	}
+
+	h.auth.Store(&types.AuthConfig{
+		Tokens:         []types.ApiToken{{Name: "viewer", Token: "viewer-secret", Role: types.RoleViewer}},
+		AllowedOrigins: []string{"https://ui.example"},
+	})
+	for origin, allowed := range map[string]bool{"https://ui.example": true, "https://anywhere.example": false} {
+		// Preflights are answered without a token
+		response = httptest.NewRecorder()
+		request = httptest.NewRequest("OPTIONS", "/tag/ValidTagF32", nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", "PUT")
+		routes.ServeHTTP(response, request)
+		if response.Code != http.StatusNoContent || (response.Header().Get("Access-Control-Allow-Origin") == origin) != allowed {
+			t.Errorf("%s: got %d %q", origin, response.Code, response.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if allowed && !strings.Contains(response.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+			t.Errorf("%s: got headers %q", origin, response.Header().Get("Access-Control-Allow-Headers"))
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	testHandler := setupTestSuite()
+	defer testHandler.cleanUp()
+	h := testHandler.handler
+	h.auth.Store(&types.AuthConfig{Tokens: []types.ApiToken{
+		{Name: "operator", Token: "operator-secret", Role: types.RoleOperator},
+		{Name: "auditor", Token: "admin-secret", Role: types.RoleAdmin},
+	}})
+	routes := h.Routes()
+	serve := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set("Content-Type", "application/json")
+		routes.ServeHTTP(response, request)
+		return response
+	}
+	audit := func(query string) []types.AuditEntry {
+		response := serve("GET", "/audit?"+query, "admin-secret", "")
+		var entries []types.AuditEntry
+		_ = json.NewDecoder(response.Body).Decode(&entries)
+		if response.Code != http.StatusOK || (!strings.Contains(query, "page") && response.Header().Get("X-Total-Count") != strconv.Itoa(len(entries))) {
+			t.Errorf("%s: got %d with %s of %d entries", query, response.Code, response.Header().Get("X-Total-Count"), len(entries))
+		}
+		return entries
+	}
+
+	serve("PUT", "/tag/ValidTagF32?value=12.5", "operator-secret", "")
+	serve("PUT", "/tag/SampleTagDigital1?value=1", "operator-secret", "")
+	_ = testHandler.mb_client.WriteRegister(11, 3)
+	_ = testHandler.mb_client.WriteFloat32(16, 6)
+	serve("POST", "/tags", "admin-secret", `{"tag": "AuditTagU16", "address": "30", "datatype": "uint16"}`)
+
+	entries := audit("tag=ValidTagF32&source=api")
+	if len(entries) != 1 || entries[0].Action != types.AuditWrite || entries[0].Actor != "operator" ||
+		entries[0].OldValue == nil || *entries[0].OldValue != 100 || *entries[0].NewValue != 12.5 || entries[0].Source != types.SourceApi {
+		t.Errorf("Got %+v", entries)
+	}
+	// A digital tag's write is recorded once, with its generic register
+	if entries := audit("tag=SampleTagDigital1&source=api"); len(entries) != 1 {
+		t.Errorf("Got %+v for a digital write", entries)
+	}
+	entries = audit("source=modbus")
+	if len(entries) != 2 || entries[0].Address != "16" || entries[1].Address != "11" || entries[0].ClientAddr == "" {
+		t.Errorf("Got %+v", entries)
+	}
+	entries = audit("action=tag_added")
+	if len(entries) != 1 || entries[0].Tag != "AuditTagU16" || entries[0].After == nil || entries[0].Before != nil || entries[0].Actor != "auditor" {
+		t.Errorf("Got %+v", entries)
+	}
+	if entries := audit("limit=2&page=2"); len(entries) != 2 || entries[0].Id <= entries[1].Id {
+		t.Errorf("Got %+v", entries)
+	}
+	if entries := audit("until=2000-01-01T00:00:00Z"); len(entries) != 0 {
+		t.Errorf("Got %+v before 2000", entries)
+	}
+
+	csvResponse := serve("GET", "/audit.csv?action=tag_added", "admin-secret", "")
+	records, err := csv.NewReader(csvResponse.Body).ReadAll()
+	if err != nil || len(records) != 2 || records[0][2] != "action" || records[1][2] != types.AuditTagAdded {
+		t.Errorf("Got %v %v", records, err)
+	}
+	if response := serve("GET", "/audit", "operator-secret", ""); response.Code != http.StatusForbidden {
+		t.Errorf("Got %d for an operator", response.Code)
+	}
+
+	// Entries can't be changed or removed
+	if _, err := h.db.Exec("UPDATE audit_log SET actor='someone'"); err == nil {
+		t.Errorf("Audit log updated")
+	}
+	if _, err := h.db.Exec("DELETE FROM audit_log"); err == nil {
+		t.Errorf("Audit log deleted")
+	}
+}
@@ -8,18 +8,17 @@ import (
 func (h Handler) Healthcheck(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		slog.Error("Healthcheck received non-get request")
-		w.WriteHeader(http.StatusBadRequest)
+		methodNotAllowed(w, r, "GET")
 		return
 	}
 	var row string
 	err := h.db.QueryRow("SELECT tag FROM datapoints;").Scan(&row)
 	if err != nil {
 		slog.Error("Unable to open database table", "error", err.Error())
-		w.WriteHeader(http.StatusFailedDependency)
+		writeError(w, http.StatusFailedDependency, ApiError{Code: ErrorUnavailable, Message: "database is unavailable"})
 		return
 	}
 	w.Header().Add("Content-Type", "application/plain-text")
-	w.Header().Add("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(http.StatusOK)
 	slog.Info("Healthcheck")
 }
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
 	"github.com/simonvetter/modbus"
 )
 
@@ -56,21 +57,52 @@ func (h *Handler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (r
 	// Write to DB entry with matching address.
 	// Only update don't insert as the DbHandler should do the inserting of null values
 	slog.Info("HandleHoldingRegisters - new request", "req", req)
+
+	// Load every row covering the request up front rather than querying per register
+	rows, err := h.db.GetRowsByAddressRange(int(req.Addr), int(req.Addr)+int(req.Quantity))
+	if err != nil {
+		slog.Error("Unable to read address range", "req", req, "err", err)
+		return res, modbus.ErrServerDeviceFailure
+	}
+
+	origin := types.WriteOrigin{
+		Source:     types.SourceModbus,
+		ClientAddr: req.ClientAddr,
+		RequestId:  newRequestId(),
+		// Set from the client certificate on tcp+tls servers
+		Actor: req.ClientRole,
+	}
+	// A write is applied whole or not at all
+	if req.IsWrite {
+		err = h.db.Transaction(func(tx *types.SqlDb) error {
+			res, err = h.holdingRegisters(tx, req, rows, origin)
+			return err
+		})
+		return res, err
+	}
+	return h.holdingRegisters(h.db, req, rows, origin)
+}
+
+// holdingRegisters serves a request for holding registers from the rows
+// covering it, writing through db
+func (h *Handler) holdingRegisters(db *types.SqlDb, req *modbus.HoldingRegistersRequest, rows map[int]types.AddressRow,
+	origin types.WriteOrigin) (res []uint16, err error) {
 	var dataType string
 	i := 0
 	for i < int(req.Quantity) {
 		// Move our request address along to service the entire quantity
 		regAddr := req.Addr + uint16(i)
 
-		// If our dataType is uninitialized we try to do it from the database.
-		// If it fails here we don't know what type of data to expect to read and it will fail
+		// If the address isn't in the database we don't know what type of data to expect
+		// and it will fail unless we allow null registers
 		regStr := strconv.Itoa(int(regAddr))
-		dataType, err = h.db.GetDataTypeByAddress(regStr)
-		if err != nil && !h.AllowNullRegisters {
+		row, found := rows[int(regAddr)]
+		dataType = row.DataType
+		if !found && !h.AllowNullRegisters {
 			slog.Error("Unable to read row data type", "address", regAddr,
-				"allow_null", h.AllowNullRegisters, "req", req, "err", err)
+				"allow_null", h.AllowNullRegisters, "req", req)
 			return res, modbus.ErrProtocolError
-		} else if dataType == "none" && h.AllowNullRegisters {
+		} else if !found {
 			dataType = "uint16"
 		}
 
@@ -102,8 +134,14 @@ func (h *Handler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (r
 				"address", regAddr, "data", data, "value", conv_val)
 
 			// Write the value we received into the DB
-			err = h.db.SetAddressValue(regStr, conv_val)
-			if err != nil {
+			err = db.SetAddressValue(regStr, conv_val, origin)
+			if errors.Is(err, types.ErrReadOnly) {
+				slog.Warn("Refusing write to read-only register", "address", regAddr, "client", req.ClientAddr)
+				return res, modbus.ErrIllegalDataAddress
+			} else if errors.Is(err, types.ErrOutOfRange) {
+				slog.Warn("Refusing write outside register limits", "address", regAddr, "value", conv_val, "err", err)
+				return res, modbus.ErrIllegalDataValue
+			} else if err != nil {
 				slog.Error("Unable to update database with holding registers",
 					"address", regAddr, "value", conv_val, "err", err)
 				return res, modbus.ErrProtocolError
@@ -111,24 +149,40 @@ func (h *Handler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (r
 
 		} else {
 			slog.Debug("Reading holding registers", "address", regAddr)
+			if row.Access == types.AccessWriteOnly {
+				slog.Warn("Refusing read of write-only register", "address", regAddr, "client", req.ClientAddr)
+				return res, modbus.ErrIllegalDataAddress
+			}
 
-			// Get the current value from the database
-			current, err := h.db.GetRowByAddress(regStr)
-			if err != nil {
+			// Take the current value from the rows we loaded
+			value := row.ValueOr(0)
+			if !row.Initialized {
 				// When we don't have a database value but allow null registers we return a 0
 				// if we don't allow null values it's considered an illegal data address
 				if h.AllowNullRegisters {
 					slog.Debug("Setting Null Register to 0")
-					current.Value = 0
 				} else {
-					slog.Error("Unable to read from database",
-						"address", regAddr, "error", err.Error())
+					slog.Error("Unable to read from database; no value",
+						"address", regAddr)
 					return res, modbus.ErrIllegalDataAddress
 				}
 			}
 
+			// Stale registers are served according to the tag's configuration; by default
+			// the last value is held
+			if row.Quality == types.QualityStale {
+				switch row.OnStale {
+				case types.StaleSubstitute:
+					slog.Debug("Substituting stale register", "address", regAddr, "value", row.StaleValue)
+					value = row.StaleValue
+				case types.StaleException:
+					slog.Warn("Refusing to serve stale register", "address", regAddr, "last_update", row.LastUpdate)
+					return res, modbus.ErrServerDeviceFailure
+				}
+			}
+
 			// Take our value and parse it into the datatype we expect to use
-			conv_val, err := parseDataTypeToByte(dataType, current.Value)
+			conv_val, err := parseDataTypeToByte(dataType, value)
 			if err != nil {
 				slog.Error("Couldn't parse DataType to Byte",
 					"DataType", dataType)
@@ -220,20 +274,5 @@ func parseByteToDataType(dataType string, bytes []uint16) (res float64, err erro
 }
 
 func numRegsDataType(dataType string) (res uint16, err error) {
-	dataType = strings.Split(dataType, "_")[0]
-	switch dataType {
-	case "float32":
-		res = 2
-	case "float64":
-		res = 4
-	case "int16":
-		res = 1
-	case "uint16":
-		res = 1
-	case "digital":
-		res = 1
-	default:
-		return 0, errors.New("Can't parse dataType: " + dataType)
-	}
-	return res, nil
+	return types.DataTypeRegisters(dataType)
 }
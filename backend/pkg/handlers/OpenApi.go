@@ -0,0 +1,388 @@
+package handlers
+
+import (
+	"cmp"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// route is an API endpoint.  Every route is described in the OpenAPI document
+// so the two can't drift apart.
+type route struct {
+	pattern    string
+	handler    http.HandlerFunc
+	path       string
+	operations map[string]operation
+}
+
+// operation describes one method of a route for the OpenAPI document
+type operation struct {
+	summary string
+	// role is needed for at least one group to use the operation, viewer if
+	// empty; global operations need it for the root group
+	role      string
+	global    bool
+	query     []string
+	headers   []string
+	request   any
+	responses map[string]response
+}
+
+// response describes a response body; body is a value of the encoded type, a
+// content type string for other bodies or nil for none
+type response struct {
+	description string
+	body        any
+}
+
+var errorResponse = response{"Error", ErrorResponse{}}
+
+// Tokens are optional until configured
+var security = []any{map[string]any{}, map[string]any{"bearer": []any{}}, map[string]any{"apiKey": []any{}}}
+
+// Query parameters filtering, sorting and paging data points
+var registerQueryParameters = []string{"tag", "description", "datatype", "group", "min_address", "max_address", "sort", "limit", "page"}
+
+// Query parameters filtering and paging the audit log
+var auditQueryParameters = []string{"action", "source", "actor", "tag", "address", "since", "until", "limit", "page"}
+
+func (h Handler) routes() []route {
+	return []route{
+		{"/all_registers", h.GetRegisters, "/all_registers", map[string]operation{
+			"get": {summary: "Read configured data points, filtered, sorted and paged", query: registerQueryParameters, responses: map[string]response{
+				"200": {"Data points", []types.ModbusResponse{}},
+				"400": errorResponse,
+			}},
+		}},
+		{"/groups/", h.GetGroup, "/groups/{path}", map[string]operation{
+			"get": {summary: "Browse the tag hierarchy; the path may span several levels and is empty for the root", query: registerQueryParameters, responses: map[string]response{
+				"200": {"Child groups and the data points at or below the group", Group{}},
+				"400": errorResponse,
+				"404": errorResponse,
+			}},
+		}},
+		{"/registers.csv", h.GetRegistersCsv, "/registers.csv", map[string]operation{
+			"get": {summary: "Export the register map and values as CSV", responses: map[string]response{
+				"200": {"Register map", "text/csv"},
+			}},
+		}},
+		{"/tag/", h.GetTag, "/tag/{tag}", map[string]operation{
+			"get": {summary: "Read a data point by tag, optionally waiting for it to change", query: []string{"wait", "since", "since_version"}, responses: map[string]response{
+				"200": {"Data point", types.ModbusResponse{}},
+				"204": {"Unchanged within the wait", nil},
+				"400": errorResponse,
+				"404": errorResponse,
+			}},
+			"put": {summary: "Write a data point by tag, only if If-Match has its ETag when given", role: types.RoleOperator, query: []string{"value"}, headers: []string{"If-Match"}, request: ValueBody{}, responses: map[string]response{
+				"200": {"Written", nil},
+				"400": errorResponse,
+				"415": errorResponse,
+				"403": errorResponse,
+				"404": errorResponse,
+				"412": errorResponse,
+			}},
+		}},
+		{"/register/", h.GetRegister, "/register/{address}", map[string]operation{
+			"get": {summary: "Read a data point by address", responses: map[string]response{
+				"200": {"Data point", types.ModbusResponse{}},
+				"404": errorResponse,
+			}},
+			"put": {summary: "Write a data point by address, only if If-Match has its ETag when given", role: types.RoleOperator, query: []string{"value"}, headers: []string{"If-Match"}, request: ValueBody{}, responses: map[string]response{
+				"200": {"Data point after the write", types.ModbusResponse{}},
+				"400": errorResponse,
+				"415": errorResponse,
+				"403": errorResponse,
+				"404": errorResponse,
+				"412": errorResponse,
+			}},
+		}},
+		{"/history/", h.GetHistory, "/history/{tag}", map[string]operation{
+			"get": {summary: "Recent value changes of a tag, newest first", query: []string{"limit"}, responses: map[string]response{
+				"200": {"Value changes", []types.HistoryEntry{}},
+				"400": errorResponse,
+				"403": errorResponse,
+				"404": errorResponse,
+			}},
+		}},
+		{"/events", h.Events, "/events", map[string]operation{
+			"get": {summary: "Stream value changes as Server-Sent Events", query: []string{"tag", "last_event_id"}, responses: map[string]response{
+				"200": {"Event stream with a ValueChange as the data of each message", "text/event-stream"},
+				"400": errorResponse,
+			}},
+		}},
+		{"/ws", h.WebSocket, "/ws", map[string]operation{
+			"get": {summary: "Subscribe to tag changes and write values over a WebSocket of WsRequest and WsMessage messages", responses: map[string]response{
+				"101": {"Switched to the WebSocket protocol", nil},
+				"400": errorResponse,
+			}},
+		}},
+		{"/batch", h.Batch, "/batch", map[string]operation{
+			"post": {summary: "Read and write many data points", request: BatchRequest{}, responses: map[string]response{
+				"200": {"Result of each item", BatchResponse{}},
+				"400": errorResponse,
+				"415": errorResponse,
+				"422": {"Result of each item of a failed atomic batch", BatchResponse{}},
+			}},
+		}},
+		{"/tags", h.TagDefinitions, "/tags", map[string]operation{
+			"get": {summary: "List tag definitions", responses: map[string]response{
+				"200": {"Tag definitions", []types.ModbusTag{}},
+			}},
+			"post": {summary: "Add a tag", role: types.RoleAdmin, query: []string{"save"}, request: types.ModbusTag{}, responses: map[string]response{
+				"201": {"Tag definition", types.ModbusTag{}},
+				"400": errorResponse,
+				"415": errorResponse,
+				"409": errorResponse,
+			}},
+		}},
+		{"/tags/", h.TagDefinition, "/tags/{tag}", map[string]operation{
+			"get": {summary: "Get a tag definition", responses: map[string]response{
+				"200": {"Tag definition", types.ModbusTag{}},
+				"404": errorResponse,
+			}},
+			"patch": {summary: "Change a tag definition", role: types.RoleAdmin, query: []string{"save"}, request: types.ModbusTag{}, responses: map[string]response{
+				"200": {"Tag definition", types.ModbusTag{}},
+				"400": errorResponse,
+				"415": errorResponse,
+				"404": errorResponse,
+				"409": errorResponse,
+			}},
+			"delete": {summary: "Remove a tag", role: types.RoleAdmin, query: []string{"save"}, responses: map[string]response{
+				"204": {"Removed", nil},
+				"404": errorResponse,
+			}},
+		}},
+		{"/audit", h.GetAudit, "/audit", map[string]operation{
+			"get": {summary: "Read the audit log of writes and tag changes, newest first", role: types.RoleAdmin, global: true, query: auditQueryParameters, responses: map[string]response{
+				"200": {"Audit entries", []types.AuditEntry{}},
+				"400": errorResponse,
+			}},
+		}},
+		{"/audit.csv", h.GetAuditCsv, "/audit.csv", map[string]operation{
+			"get": {summary: "Export the audit log as CSV", role: types.RoleAdmin, global: true, query: auditQueryParameters, responses: map[string]response{
+				"200": {"Audit entries", "text/csv"},
+				"400": errorResponse,
+			}},
+		}},
+		{"/healthcheck", h.Healthcheck, "/healthcheck", map[string]operation{
+			"get": {summary: "Check the database can be read", responses: map[string]response{
+				"200": {"Healthy", nil},
+				"424": errorResponse,
+			}},
+		}},
+		{"/admin/backup", h.Backup, "/admin/backup", map[string]operation{
+			"get": {summary: "Download a database snapshot", role: types.RoleAdmin, global: true, responses: map[string]response{
+				"200": {"Database snapshot", "application/vnd.sqlite3"},
+			}},
+		}},
+		{"/admin/restore", h.Restore, "/admin/restore", map[string]operation{
+			"post": {summary: "Restore values from a database snapshot", role: types.RoleAdmin, global: true, request: "application/vnd.sqlite3", responses: map[string]response{
+				"200": {"Restored", nil},
+				"400": errorResponse,
+				"415": errorResponse,
+			}},
+		}},
+		{"/admin/reload", h.PostReload, "/admin/reload", map[string]operation{
+			"post": {summary: "Reload the register map from the configuration file", role: types.RoleAdmin, global: true, responses: map[string]response{
+				"200": {"What the reload changed", ReloadReport{}},
+				"400": errorResponse,
+			}},
+		}},
+		{"/openapi.json", h.GetOpenApi, "/openapi.json", map[string]operation{
+			"get": {summary: "This document", responses: map[string]response{
+				"200": {"OpenAPI document", map[string]any{}},
+			}},
+		}},
+	}
+}
+
+// GetOpenApi serves the OpenAPI 3 document describing every route
+func (h Handler) GetOpenApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	writeJson(w, http.StatusOK, h.OpenApi())
+}
+
+// OpenApi builds the OpenAPI document from the route table, with schemas
+// generated from the types each route encodes
+func (h Handler) OpenApi() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	for _, route := range h.routes() {
+		item := map[string]any{}
+		for method, op := range route.operations {
+			item[method] = op.document(route.path, schemas)
+		}
+		paths[route.path] = item
+	}
+	// Messages of the event stream and WebSocket, which OpenAPI can't describe
+	for _, message := range []any{types.ValueChange{}, WsRequest{}, WsMessage{}} {
+		schemaOf(reflect.TypeOf(message), schemas)
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Modbus Slave API",
+			"version": "1",
+		},
+		"servers": []any{
+			map[string]any{"url": ApiPrefix},
+		},
+		"paths": paths,
+		"security": security,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearer":      map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey":      map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"accessToken": map[string]any{"type": "apiKey", "in": "query", "name": "access_token"},
+			},
+		},
+	}
+}
+
+func (op operation) document(path string, schemas map[string]any) map[string]any {
+	var parameters []any
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") {
+			parameters = append(parameters, map[string]any{
+				"name": strings.Trim(segment, "{}"), "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+	}
+	for _, name := range op.query {
+		parameters = append(parameters, map[string]any{
+			"name": name, "in": "query", "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, name := range op.headers {
+		parameters = append(parameters, map[string]any{
+			"name": name, "in": "header", "schema": map[string]any{"type": "string"},
+		})
+	}
+
+	// Any operation is refused without a suitable token once tokens are configured
+	responses := map[string]any{
+		"default": errorResponse.document(schemas),
+		"401":     response{"No valid token", ErrorResponse{}}.document(schemas),
+		"403":     response{"Not permitted for the token's role", ErrorResponse{}}.document(schemas),
+	}
+	for status, response := range op.responses {
+		responses[status] = response.document(schemas)
+	}
+	role := cmp.Or(op.role, types.RoleViewer)
+	description := "Needs the " + role + " role for the data points' groups when tokens are configured."
+	if op.global {
+		description = "Needs the " + role + " role for the root group when tokens are configured."
+	}
+	document := map[string]any{
+		"summary":     op.summary,
+		"description": description,
+		"responses":   responses,
+	}
+	if parameters != nil {
+		document["parameters"] = parameters
+	}
+	if queryTokenRoutes[path] {
+		document["security"] = append(slices.Clip(security), map[string]any{"accessToken": []any{}})
+	}
+	if op.request != nil {
+		document["requestBody"] = map[string]any{"content": content(op.request, schemas)}
+	}
+	return document
+}
+
+func (r response) document(schemas map[string]any) map[string]any {
+	document := map[string]any{"description": r.description}
+	if r.body != nil {
+		document["content"] = content(r.body, schemas)
+	}
+	return document
+}
+
+// content describes a body given as an example value or a content type
+func content(body any, schemas map[string]any) map[string]any {
+	if contentType, ok := body.(string); ok {
+		return map[string]any{contentType: map[string]any{
+			"schema": map[string]any{"type": "string", "format": "binary"},
+		}}
+	}
+	return map[string]any{"application/json": map[string]any{
+		"schema": schemaOf(reflect.TypeOf(body), schemas),
+	}}
+}
+
+// schemaOf describes how a Go type is encoded as JSON.  Structs are added to
+// schemas and referenced by name.
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaOf(t.Elem(), schemas)
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Uint16:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64, reflect.Float32:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		// Nil slices are encoded as null
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas), "nullable": true}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		if _, found := schemas[t.Name()]; !found {
+			// Reserve the name first so recursive types terminate
+			schemas[t.Name()] = nil
+			properties := map[string]any{}
+			var required []string
+			structProperties(t, schemas, properties, &required)
+			schema := map[string]any{"type": "object", "properties": properties}
+			if required != nil {
+				schema["required"] = required
+			}
+			schemas[t.Name()] = schema
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// structProperties adds the JSON fields of a struct, including those of
+// embedded structs, to properties
+func structProperties(t reflect.Type, schemas map[string]any, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" {
+			structProperties(field.Type, schemas, properties, required)
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, schemas)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// ReloadReport describes what a reload changed
+type ReloadReport struct {
+	types.RegisterDiff
+	Reconcile types.ReconcileReport `json:"reconcile"`
+}
+
+// Reload rereads the configuration file and applies its register map without
+// restarting the Modbus server, so connected clients stay connected.  Only the
+// register map, orphan policy and auth are reloaded; ports, the database and
+// allow_null_register still need a restart.  Changed tags are audited as made
+// by origin in the same transaction as the database is updated.
+func (h Handler) Reload(origin types.WriteOrigin) (ReloadReport, error) {
+	if h.ConfigPath == "" {
+		return ReloadReport{}, errors.New("No configuration file to reload")
+	}
+	h.registers.update.Lock()
+	defer h.registers.update.Unlock()
+
+	config, err := types.Configuration{}.ReadConfig(h.ConfigPath, h.ConfigOverrides...)
+	if err != nil {
+		return ReloadReport{}, err
+	}
+
+	previous := h.registers.Get()
+	report := ReloadReport{RegisterDiff: types.DiffRegisters(previous, config.Registers)}
+	err = h.db.Transaction(func(tx *types.SqlDb) (err error) {
+		report.Reconcile, err = tx.ApplyRegisters(previous, config.Registers, nil, config.OrphanPolicy, origin)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	h.registers.swap(config.Registers)
+	h.registers.orphanPolicy = config.OrphanPolicy
+	h.auth.Store(&config.Auth)
+
+	slog.Info("Configuration reloaded", "path", h.ConfigPath, "added", report.Added,
+		"removed", report.Removed, "changed", report.Changed, "reconcile", report.Reconcile)
+	return report, nil
+}
+
+func (h Handler) PostReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+
+	report, err := h.Reload(apiOrigin(w, r))
+	var problems types.ConfigProblems
+	if errors.As(err, &problems) {
+		slog.Error("Reloaded configuration is invalid", "error", err)
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidConfig, Message: err.Error()})
+		return
+	} else if err != nil {
+		slog.Error("Unable to reload configuration", "error", err)
+		internalError(w, ApiError{Message: err.Error()})
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		slog.Error("Unable to write response", "error", err)
+		return
+	}
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+)
+
+// TagDefinitions lists the visible register map or adds a register to it
+func (h Handler) TagDefinitions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJson(w, http.StatusOK, sortedRegisters(h.visibleRegisters(r)))
+
+	case "POST":
+		var register types.ModbusTag
+		if !decodeTagBody(w, r, &register) {
+			return
+		}
+		if !h.permitted(r, register.Path, types.RoleAdmin) {
+			forbidden(w, ApiError{Message: "not permitted to add tags to group " + strconv.Quote(register.Path), Tag: register.Tag})
+			return
+		}
+		h.registers.update.Lock()
+		defer h.registers.update.Unlock()
+
+		current := h.registers.Get()
+		if _, found := current[types.InstrumentTag(register.Tag)]; found {
+			writeError(w, http.StatusConflict, ApiError{Code: ErrorConflict, Message: "tag already exists", Tag: register.Tag})
+			return
+		}
+		updated := maps.Clone(current)
+		updated[types.InstrumentTag(register.Tag)] = register
+		if !h.applyRegisters(w, r, updated, register) {
+			return
+		}
+		slog.Info("Tag added", "tag", register.Tag, "register", register)
+		writeJson(w, http.StatusCreated, register)
+
+	default:
+		methodNotAllowed(w, r, "GET, POST")
+	}
+}
+
+// TagDefinition reads, changes or removes a single register definition.  PATCH
+// only replaces the fields given in the body, properties included as a whole;
+// renaming is done by giving a new tag.
+func (h Handler) TagDefinition(w http.ResponseWriter, r *http.Request) {
+	tag := types.InstrumentTag(strings.TrimPrefix(r.URL.Path, "/tags/"))
+	if r.Method != "GET" && r.Method != "PATCH" && r.Method != "DELETE" {
+		methodNotAllowed(w, r, "GET, PATCH, DELETE")
+		return
+	}
+	if r.Method != "GET" {
+		h.registers.update.Lock()
+		defer h.registers.update.Unlock()
+	}
+
+	current := h.registers.Get()
+	register, found := current[tag]
+	if !found {
+		writeError(w, http.StatusNotFound, ApiError{Code: ErrorNotFound, Message: "tag not found", Tag: string(tag)})
+		return
+	}
+
+	need := types.RoleAdmin
+	if r.Method == "GET" {
+		need = types.RoleViewer
+	}
+	if !h.permitted(r, register.Path, need) {
+		forbidden(w, ApiError{Message: "not permitted to " + strings.ToLower(r.Method) + " tag", Tag: string(tag)})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJson(w, http.StatusOK, register)
+
+	case "PATCH":
+		// The body is decoded into a copy so a refused change can't reach the live map
+		register = register.Clone()
+		if !decodeTagBody(w, r, &register) {
+			return
+		}
+		if !h.permitted(r, register.Path, types.RoleAdmin) {
+			forbidden(w, ApiError{Message: "not permitted to move tags to group " + strconv.Quote(register.Path), Tag: string(tag)})
+			return
+		}
+		updated := maps.Clone(current)
+		delete(updated, tag)
+		if _, found := updated[types.InstrumentTag(register.Tag)]; found {
+			writeError(w, http.StatusConflict, ApiError{Code: ErrorConflict, Message: "tag already exists", Tag: register.Tag})
+			return
+		}
+		updated[types.InstrumentTag(register.Tag)] = register
+		if !h.applyRegisters(w, r, updated, register) {
+			return
+		}
+		slog.Info("Tag changed", "tag", tag, "register", register)
+		writeJson(w, http.StatusOK, register)
+
+	case "DELETE":
+		updated := maps.Clone(current)
+		delete(updated, tag)
+		if !h.applyRegisters(w, r, updated) {
+			return
+		}
+		slog.Info("Tag deleted", "tag", tag)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeTagBody decodes a tag definition over register.  Properties given in
+// the body replace the register's rather than being merged into them.
+func decodeTagBody(w http.ResponseWriter, r *http.Request, register *types.ModbusTag) bool {
+	if err := requireJson(r); err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, ApiError{Code: ErrorInvalidRequest, Message: err.Error()})
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "unable to read tag definition: " + err.Error()})
+		return false
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil && fields["properties"] != nil {
+		register.Properties = nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(register)
+	if err != nil {
+		slog.Warn("Could not decode tag definition", "error", err)
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidRequest, Message: "invalid tag definition: " + err.Error()})
+		return false
+	}
+	*register = register.ResolveDefault()
+	return true
+}
+
+// applyRegisters validates a replacement register map and applies it to the
+// database in one transaction, saving it to the configuration file as well when
+// ?save=true, before swapping it in.  Only the given changed registers are
+// written to the database; rows no longer needed by the map are handled by the
+// orphan policy and the changes are audited in the same transaction.  The
+// caller must hold the register map's update lock.
+func (h Handler) applyRegisters(w http.ResponseWriter, r *http.Request,
+	updated map[types.InstrumentTag]types.ModbusTag, changed ...types.ModbusTag) bool {
+	if problems := types.ValidateRegisters(sortedRegisters(updated), nil); len(problems) > 0 {
+		writeError(w, http.StatusBadRequest, ApiError{Code: ErrorInvalidConfig, Message: problems.Error()})
+		return false
+	}
+	save := r.URL.Query().Get("save") == "true"
+	if save && h.ConfigPath == "" {
+		writeError(w, http.StatusConflict, ApiError{Code: ErrorConflict, Message: "no configuration file to save to"})
+		return false
+	}
+
+	changedMap := make(map[types.InstrumentTag]types.ModbusTag)
+	for _, register := range changed {
+		changedMap[types.InstrumentTag(register.Tag)] = register
+	}
+	previous := h.registers.Get()
+	origin := apiOrigin(w, r)
+	status, failure := http.StatusInternalServerError, ApiError{Code: ErrorInternal}
+	saved := false
+	err := h.db.Transaction(func(tx *types.SqlDb) error {
+		_, err := tx.ApplyRegisters(previous, updated, changedMap, h.registers.orphanPolicy, origin)
+		if err != nil {
+			failure.Message = "unable to update registers"
+			return err
+		}
+		if !save {
+			return nil
+		}
+		// The file is written last so a failure leaves the database as it was
+		err = types.SaveRegisters(h.ConfigPath, updated, h.ConfigOverrides...)
+		if errors.Is(err, types.ErrExternalRegister) {
+			status, failure = http.StatusConflict, ApiError{Code: ErrorConflict, Message: err.Error()}
+		} else if err != nil {
+			failure.Message = "unable to save configuration"
+		}
+		saved = err == nil
+		return err
+	})
+	if err != nil {
+		slog.Error("Unable to apply registers", "error", err)
+		if saved {
+			// Only the commit failed, so the file is put back to match the database
+			if err := types.SaveRegisters(h.ConfigPath, previous, h.ConfigOverrides...); err != nil {
+				slog.Error("Unable to restore configuration file", "path", h.ConfigPath, "error", err)
+			}
+		}
+		writeError(w, status, failure)
+		return false
+	}
+	h.registers.swap(updated)
+	return true
+}
+
+func sortedRegisters(registers map[types.InstrumentTag]types.ModbusTag) []types.ModbusTag {
+	sorted := make([]types.ModbusTag, 0, len(registers))
+	for _, register := range registers {
+		sorted = append(sorted, register)
+	}
+	slices.SortFunc(sorted, compareAddress)
+	return sorted
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		slog.Error("Unable to write response", "error", err)
+	}
+}
+
+// errNotJson refuses a body not sent as JSON.  Browsers send JSON to another
+// origin only after a preflight, so this keeps other sites' forms from writing.
+var errNotJson = errors.New("the body must be sent with Content-Type: application/json")
+
+func requireJson(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return errNotJson
+	}
+	return nil
+}
+
+// bodyStatus is the status refusing a request whose body couldn't be read
+func bodyStatus(err error) int {
+	if errors.Is(err, errNotJson) {
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
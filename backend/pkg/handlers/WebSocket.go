@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dshargool/go-mbslave-api.git/pkg/types"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket timings; pings are sent often enough to keep the read deadline moving
+const (
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 25 * time.Second
+	wsWriteWait  = 10 * time.Second
+)
+
+// Message types sent and received over the WebSocket
+const (
+	WsSubscribe   = "subscribe"
+	WsUnsubscribe = "unsubscribe"
+	WsWrite       = "write"
+	WsResult      = "result"
+	WsValue       = "value"
+	WsChange      = "change"
+	WsReset       = "reset"
+)
+
+// WsRequest is a message from the client.  Subscriptions take tag globs and an
+// optional deadband; writes take a tag or address and a value.  Id is echoed in
+// the result.
+type WsRequest struct {
+	Type     string   `json:"type"`
+	Id       string   `json:"id,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Deadband float64  `json:"deadband,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	Value    *float64 `json:"value,omitempty"`
+}
+
+// WsMessage is a message to the client: the result of a request, the current
+// value of a newly subscribed tag, or a change to a subscribed tag
+type WsMessage struct {
+	Type   string                `json:"type"`
+	Id     string                `json:"id,omitempty"`
+	Status int                   `json:"status,omitempty"`
+	Result *types.ModbusResponse `json:"result,omitempty"`
+	Change *types.ValueChange    `json:"change,omitempty"`
+	Error  *ApiError             `json:"error,omitempty"`
+}
+
+// upgrader's origins are checked by each handler against the allowed origins
+var upgrader = websocket.Upgrader{
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, status, ApiError{Code: ErrorInvalidRequest, Message: reason.Error()})
+	},
+}
+
+// wsSession is the state of one WebSocket connection
+type wsSession struct {
+	h Handler
+	// request that opened the connection, whose token applies to every message
+	request *http.Request
+	out     chan WsMessage
+	// Closed once nothing more will be written to the connection
+	closed chan struct{}
+	// Client address used as the origin of writes
+	clientAddr string
+
+	mu sync.Mutex
+	// Subscribed tag globs and their deadbands
+	patterns map[string]float64
+	// Last value sent for each tag, for deadband filtering
+	sent map[string]float64
+}
+
+// WebSocket serves subscriptions to tag changes and writes over one connection
+func (h Handler) WebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	wsUpgrader := upgrader
+	wsUpgrader.CheckOrigin = h.checkOrigin
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Unable to upgrade WebSocket", "client", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+	slog.Info("WebSocket opened", "client", r.RemoteAddr)
+
+	s := &wsSession{
+		h:          h,
+		request:    r,
+		out:        make(chan WsMessage, eventBuffer),
+		closed:     make(chan struct{}),
+		clientAddr: r.RemoteAddr,
+		patterns:   make(map[string]float64),
+		sent:       make(map[string]float64),
+	}
+	sub := h.db.Changes.Subscribe(eventBuffer)
+	defer func() { sub.Close() }()
+	defer close(s.closed)
+
+	done := make(chan struct{})
+	go s.read(conn, done)
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		var message WsMessage
+		select {
+		case <-done:
+			slog.Info("WebSocket closed", "client", r.RemoteAddr)
+			return
+		case message = <-s.out:
+		case change, open := <-sub.C:
+			if !open {
+				// Fell behind; start again from the current values
+				sub = h.db.Changes.Subscribe(eventBuffer)
+				s.resync()
+				continue
+			}
+			if !s.wants(change) {
+				continue
+			}
+			message = WsMessage{Type: WsChange, Change: &change}
+		case <-ping.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			continue
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteJSON(message); err != nil {
+			slog.Warn("Unable to write to WebSocket", "client", r.RemoteAddr, "error", err)
+			return
+		}
+	}
+}
+
+// read handles requests until the connection closes
+func (s *wsSession) read(conn *websocket.Conn, done chan<- struct{}) {
+	defer close(done)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request WsRequest
+		err = json.Unmarshal(raw, &request)
+		if err != nil {
+			s.send(WsMessage{Type: WsResult, Status: http.StatusBadRequest,
+				Error: &ApiError{Code: ErrorInvalidRequest, Message: "invalid message: " + err.Error()}})
+			continue
+		}
+		s.handle(request)
+	}
+}
+
+func (s *wsSession) send(message WsMessage) {
+	select {
+	case s.out <- message:
+	case <-s.closed:
+	}
+}
+
+func (s *wsSession) fail(request WsRequest, status int, code string, message string) {
+	s.send(WsMessage{Type: WsResult, Id: request.Id, Status: status,
+		Error: &ApiError{Code: code, Message: message, Tag: request.Tag, Address: request.Address}})
+}
+
+func (s *wsSession) handle(request WsRequest) {
+	switch request.Type {
+	case WsSubscribe:
+		if request.Deadband < 0 || math.IsNaN(request.Deadband) {
+			s.fail(request, http.StatusBadRequest, ErrorInvalidRequest, "deadband must not be negative")
+			return
+		}
+		for _, pattern := range request.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				s.fail(request, http.StatusBadRequest, ErrorInvalidRequest, "invalid tag pattern "+strconv.Quote(pattern))
+				return
+			}
+		}
+		s.mu.Lock()
+		for _, pattern := range request.Tags {
+			s.patterns[pattern] = request.Deadband
+		}
+		s.mu.Unlock()
+		s.send(WsMessage{Type: WsResult, Id: request.Id, Status: http.StatusOK})
+		s.sendValues(request.Tags)
+
+	case WsUnsubscribe:
+		s.mu.Lock()
+		for _, pattern := range request.Tags {
+			delete(s.patterns, pattern)
+		}
+		s.mu.Unlock()
+		s.send(WsMessage{Type: WsResult, Id: request.Id, Status: http.StatusOK})
+
+	case WsWrite:
+		if (request.Tag == "") == (request.Address == "") {
+			s.fail(request, http.StatusBadRequest, ErrorInvalidRequest, "give either a tag or an address")
+			return
+		} else if request.Value == nil {
+			s.fail(request, http.StatusBadRequest, ErrorInvalidValue, "missing value")
+			return
+		}
+		requestId := request.Id
+		if requestId == "" {
+			requestId = newRequestId()
+		}
+		origin := types.WriteOrigin{Source: types.SourceApi, ClientAddr: s.clientAddr, RequestId: requestId, Actor: actor(s.request)}
+		var row types.ModbusResponse
+		var err error
+		if request.Tag != "" {
+			if !s.h.permittedTag(s.request, request.Tag, types.RoleOperator) {
+				s.fail(request, http.StatusForbidden, ErrorForbidden, "not permitted to write tag")
+				return
+			}
+			err = s.h.db.SetTagValue(request.Tag, *request.Value, origin)
+			if err == nil {
+				row, err = s.h.db.GetRowByTag(request.Tag)
+			}
+		} else {
+			if !s.h.permittedAddress(s.request, request.Address, types.RoleOperator) {
+				s.fail(request, http.StatusForbidden, ErrorForbidden, "not permitted to write register")
+				return
+			}
+			err = s.h.db.SetAddressValue(request.Address, *request.Value, origin)
+			if err == nil {
+				row, err = s.h.db.GetRowByAddress(request.Address)
+			}
+		}
+		if status, apiErr, refused := writeRefused(err); refused {
+			s.fail(request, status, apiErr.Code, apiErr.Message)
+			return
+		} else if err == sql.ErrNoRows && request.Tag != "" {
+			s.fail(request, http.StatusNotFound, ErrorNotFound, "tag not found")
+			return
+		} else if err == sql.ErrNoRows {
+			s.fail(request, http.StatusNotFound, ErrorNotFound, "register not found")
+			return
+		} else if err != nil {
+			slog.Error("Unable to write from WebSocket", "tag", request.Tag, "address", request.Address, "error", err)
+			s.fail(request, http.StatusInternalServerError, ErrorInternal, "unable to write value")
+			return
+		}
+		s.send(WsMessage{Type: WsResult, Id: request.Id, Status: http.StatusOK, Result: &row})
+
+	default:
+		s.fail(request, http.StatusBadRequest, ErrorInvalidRequest, "unknown message type "+strconv.Quote(request.Type))
+	}
+}
+
+// sendValues sends the current value of every visible tag matching patterns
+func (s *wsSession) sendValues(patterns []string) {
+	for _, register := range sortedRegisters(s.h.visibleRegisters(s.request)) {
+		if !matchTag(patterns, register.Tag) {
+			continue
+		}
+		row, err := s.h.db.GetRowByTag(register.Tag)
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		if row.Value != nil {
+			s.sent[row.Tag] = *row.Value
+		} else {
+			delete(s.sent, row.Tag)
+		}
+		s.mu.Unlock()
+		s.send(WsMessage{Type: WsValue, Result: &row})
+	}
+}
+
+// resync tells the client changes were missed and sends every subscribed value
+func (s *wsSession) resync() {
+	s.mu.Lock()
+	patterns := make([]string, 0, len(s.patterns))
+	for pattern := range s.patterns {
+		patterns = append(patterns, pattern)
+	}
+	s.mu.Unlock()
+	go func() {
+		s.send(WsMessage{Type: WsReset})
+		if len(patterns) > 0 {
+			s.sendValues(patterns)
+		}
+	}()
+}
+
+// wants reports whether a change is to a visible tag subscribed to and outside
+// the smallest matching deadband of the last value sent
+func (s *wsSession) wants(change types.ValueChange) bool {
+	if !s.h.permittedTag(s.request, change.Tag, types.RoleViewer) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadband := math.Inf(1)
+	for pattern, patternDeadband := range s.patterns {
+		if matched, _ := path.Match(pattern, change.Tag); matched {
+			deadband = min(deadband, patternDeadband)
+		}
+	}
+	if math.IsInf(deadband, 1) {
+		return false
+	}
+	if last, found := s.sent[change.Tag]; found && deadband > 0 && math.Abs(change.Value-last) < deadband {
+		return false
+	}
+	s.sent[change.Tag] = change.Value
+	return true
+}
@@ -0,0 +1,140 @@
+package types
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Who may read and write a datapoint over the API and Modbus
+const (
+	AccessReadWrite = "read-write"
+	AccessReadOnly  = "read-only"
+	AccessWriteOnly = "write-only"
+)
+
+var accessModes = []string{AccessReadWrite, AccessReadOnly, AccessWriteOnly}
+
+// registerAccess selects the access mode of a datapoint d as seen by a read of
+// its whole register, which would reveal the value of any write-only bits
+const registerAccess = `CASE WHEN EXISTS (SELECT 1 FROM datapoints b WHERE b.disabled=0
+    AND b.address GLOB d.address || '_*' AND b.access = '` + AccessWriteOnly + `')
+    THEN '` + AccessWriteOnly + `' ELSE COALESCE(d.access, '') END`
+
+// Writes refused by a datapoint's access mode or limits
+var (
+	ErrReadOnly   = errors.New("read-only")
+	ErrOutOfRange = errors.New("out of range")
+)
+
+// checkWrite refuses a write the access mode or limits of the datapoint whose
+// column ("address" or "tag") matches key don't allow.  Configured initial
+// values are always written.
+func (db *SqlDb) checkWrite(column string, key string, value float64, origin WriteOrigin) error {
+	if origin.Source == SourceConfig {
+		return nil
+	}
+	var access string
+	var minimum, maximum sql.NullFloat64
+	err := db.QueryRow("SELECT COALESCE(access, ''), min_value, max_value FROM datapoints WHERE "+column+"=$1 AND disabled=0", key).
+		Scan(&access, &minimum, &maximum)
+	if err != nil {
+		return err
+	}
+	if access == AccessReadOnly {
+		return fmt.Errorf("%w: %s %s can't be written", ErrReadOnly, column, key)
+	}
+	err = checkLimits(value, minimum, maximum)
+	if err != nil || column != "address" || strings.Contains(key, "_") {
+		return err
+	}
+	return db.checkBitWrites(key, value)
+}
+
+// checkBitWrites refuses a write to a whole register that changes a read-only
+// bit or takes a bit outside its limits
+func (db *SqlDb) checkBitWrites(address string, value float64) error {
+	var current sql.NullFloat64
+	err := db.QueryRow("SELECT value FROM datapoints WHERE address=$1 AND disabled=0", address).Scan(&current)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT address, COALESCE(access, ''), min_value, max_value FROM datapoints WHERE address GLOB $1 AND disabled=0",
+		address+"_*")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bitAddress, access string
+		var minimum, maximum sql.NullFloat64
+		err = rows.Scan(&bitAddress, &access, &minimum, &maximum)
+		if err != nil {
+			return err
+		}
+		_, digit, _ := strings.Cut(bitAddress, "_")
+		shift, err := strconv.Atoi(digit)
+		if err != nil {
+			return err
+		}
+		bit := float64((uint64(value) >> shift) & 1)
+		if access == AccessReadOnly && bit != float64((uint64(current.Float64)>>shift)&1) {
+			return fmt.Errorf("%w: address %s can't be written", ErrReadOnly, bitAddress)
+		}
+		err = checkLimits(bit, minimum, maximum)
+		if err != nil {
+			return fmt.Errorf("address %s: %w", bitAddress, err)
+		}
+	}
+	return rows.Err()
+}
+
+// checkLimits refuses a value outside a datapoint's limits
+func checkLimits(value float64, minimum sql.NullFloat64, maximum sql.NullFloat64) error {
+	if minimum.Valid && value < minimum.Float64 {
+		return fmt.Errorf("%w: %s is below the minimum of %s", ErrOutOfRange, formatValue(value), formatValue(minimum.Float64))
+	}
+	if maximum.Valid && value > maximum.Float64 {
+		return fmt.Errorf("%w: %s is above the maximum of %s", ErrOutOfRange, formatValue(value), formatValue(maximum.Float64))
+	}
+	return nil
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// setMetadata fills in a datapoint's metadata from its columns, hiding the
+// value of a write-only datapoint
+func (r *ModbusResponse) setMetadata(access string, minimum sql.NullFloat64, maximum sql.NullFloat64, properties string) error {
+	r.Access = access
+	if r.Access == "" {
+		r.Access = AccessReadWrite
+	}
+	if r.Access == AccessWriteOnly {
+		r.Value = nil
+	}
+	if minimum.Valid {
+		r.Min = &minimum.Float64
+	}
+	if maximum.Valid {
+		r.Max = &maximum.Float64
+	}
+	r.Properties = map[string]string{}
+	if properties == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(properties), &r.Properties)
+}
+
+// encodeProperties stores a tag's properties as JSON, or empty if it has none
+func encodeProperties(properties map[string]string) string {
+	if len(properties) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(properties)
+	return string(encoded)
+}
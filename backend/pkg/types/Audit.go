@@ -0,0 +1,275 @@
+package types
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Actions recorded in the audit log
+const (
+	// AuditWrite is a value written over the API or Modbus, or from the
+	// configuration's initial values
+	AuditWrite      = "write"
+	AuditTagAdded   = "tag_added"
+	AuditTagChanged = "tag_changed"
+	AuditTagRemoved = "tag_removed"
+	// AuditRestore replaced every value from a database snapshot
+	AuditRestore = "restore"
+)
+
+// AuditActions lists every action recorded in the audit log
+func AuditActions() []string {
+	return []string{AuditWrite, AuditTagAdded, AuditTagChanged, AuditTagRemoved, AuditRestore}
+}
+
+// AuditEntry is one row of the append-only audit log.  Writes record the value
+// before and after them; tag changes record the definition before and after.
+type AuditEntry struct {
+	Id        int64      `json:"id"`
+	Timestamp string     `json:"timestamp"`
+	Action    string     `json:"action"`
+	Tag       string     `json:"tag"`
+	Address   string     `json:"address"`
+	OldValue  *float64   `json:"old_value"`
+	NewValue  *float64   `json:"new_value"`
+	Before    *ModbusTag `json:"before,omitempty"`
+	After     *ModbusTag `json:"after,omitempty"`
+	WriteOrigin
+}
+
+// createAuditLog creates the audit log, which triggers keep append-only, and
+// the trigger recording every write to a value in it
+func (db *SqlDb) createAuditLog() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp TEXT DEFAULT CURRENT_TIMESTAMP,
+		action TEXT NOT NULL,
+		tag TEXT,
+		address TEXT,
+		old_value REAL,
+		new_value REAL,
+		before TEXT,
+		after TEXT,
+		source TEXT,
+		actor TEXT,
+		client_addr TEXT,
+		request_id TEXT);
+	CREATE INDEX IF NOT EXISTS audit_log_timestamp ON audit_log (timestamp);
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_update
+	BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END;
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_delete
+	BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END;
+	CREATE TRIGGER IF NOT EXISTS audit_value_write
+	AFTER UPDATE OF value ON datapoints
+	FOR EACH ROW
+	BEGIN
+		INSERT INTO audit_log (action, tag, address, old_value, new_value, source, actor, client_addr, request_id)
+		VALUES ('` + AuditWrite + `', NEW.tag, NEW.address, OLD.value, NEW.value, NEW.source, NEW.actor, NEW.client_addr, NEW.request_id);
+	END;
+	`)
+	return err
+}
+
+const insertAudit = `INSERT INTO audit_log (action, tag, address, old_value, new_value, before, after,
+    source, actor, client_addr, request_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+// insertArgs are the arguments of insertAudit for the entry
+func (entry AuditEntry) insertArgs() []any {
+	return []any{entry.Action, entry.Tag, entry.Address, entry.OldValue, entry.NewValue, encodeRegister(entry.Before), encodeRegister(entry.After),
+		entry.Source, entry.Actor, entry.ClientAddr, entry.RequestId}
+}
+
+// Audit appends an entry other than a write, which are recorded as they are
+// made.  It should be called in the transaction making the change so the two
+// can't part.
+func (db *SqlDb) Audit(entry AuditEntry) error {
+	slog.Info("Audit", "action", entry.Action, "tag", entry.Tag, "actor", entry.Actor, "source", entry.Source)
+	_, err := db.Exec(insertAudit, entry.insertArgs()...)
+	return err
+}
+
+// AuditRegisters records every tag added, removed or changed between two
+// register maps
+func (db *SqlDb) AuditRegisters(origin WriteOrigin, previous map[InstrumentTag]ModbusTag, updated map[InstrumentTag]ModbusTag) error {
+	diff := DiffRegisters(previous, updated)
+	for _, changes := range []struct {
+		action string
+		tags   []string
+	}{
+		{AuditTagAdded, diff.Added},
+		{AuditTagChanged, diff.Changed},
+		{AuditTagRemoved, diff.Removed},
+	} {
+		for _, tag := range changes.tags {
+			entry := AuditEntry{Action: changes.action, Tag: tag, WriteOrigin: origin}
+			if before, found := previous[InstrumentTag(tag)]; found {
+				entry.Before = &before
+				entry.Address = before.Address
+			}
+			if after, found := updated[InstrumentTag(tag)]; found {
+				entry.After = &after
+				entry.Address = after.Address
+			}
+			if err := db.Audit(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AuditedRegisters returns the register map as last recorded in the audit log,
+// which is what the database was last configured with
+func (db *SqlDb) AuditedRegisters() (map[InstrumentTag]ModbusTag, error) {
+	rows, err := db.Query(`SELECT COALESCE(after, '') FROM audit_log WHERE id IN (
+    SELECT MAX(id) FROM audit_log WHERE action IN ($1, $2, $3) GROUP BY tag)`,
+		AuditTagAdded, AuditTagChanged, AuditTagRemoved)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registers := make(map[InstrumentTag]ModbusTag)
+	for rows.Next() {
+		var after string
+		if err = rows.Scan(&after); err != nil {
+			return nil, err
+		}
+		// Removed tags have no definition after
+		register, err := decodeRegister(after)
+		if err != nil {
+			return nil, err
+		}
+		if register != nil {
+			registers[InstrumentTag(register.Tag)] = *register
+		}
+	}
+	return registers, rows.Err()
+}
+
+// encodeRegister stores a tag definition as JSON, or NULL without one
+func encodeRegister(register *ModbusTag) any {
+	if register == nil {
+		return nil
+	}
+	encoded, _ := json.Marshal(register)
+	return string(encoded)
+}
+
+func decodeRegister(encoded string) (*ModbusTag, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	register := &ModbusTag{}
+	return register, json.Unmarshal([]byte(encoded), register)
+}
+
+// AuditQuery filters and pages the entries returned by QueryAudit
+type AuditQuery struct {
+	// Actions, any of which may match
+	Actions []string
+	Source  string
+	Actor   string
+	// Tag glob such as "Pump*"
+	Tag     string
+	Address string
+	// Inclusive range of timestamps in the log's "2006-01-02 15:04:05" UTC form
+	Since string
+	Until string
+	// Maximum entries returned, 0 for all of them, after skipping Offset entries
+	Limit  int
+	Offset int
+}
+
+// QueryAudit returns a page of the audit entries matching query, newest first,
+// and how many match in total
+func (db *SqlDb) QueryAudit(query AuditQuery) (entries []AuditEntry, total int, err error) {
+	var args []any
+	param := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	conditions := []string{"1=1"}
+	if len(query.Actions) > 0 {
+		actions, _ := json.Marshal(query.Actions)
+		conditions = append(conditions, "action IN (SELECT value FROM json_each("+param(string(actions))+"))")
+	}
+	for _, filter := range [][2]string{{"source", query.Source}, {"actor", query.Actor}, {"address", query.Address}} {
+		if filter[1] != "" {
+			conditions = append(conditions, filter[0]+" = "+param(filter[1]))
+		}
+	}
+	if query.Tag != "" {
+		conditions = append(conditions, "tag GLOB "+param(query.Tag))
+	}
+	if query.Since != "" {
+		conditions = append(conditions, "timestamp >= "+param(query.Since))
+	}
+	if query.Until != "" {
+		conditions = append(conditions, "timestamp <= "+param(query.Until))
+	}
+	limit := -1
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+
+	// The count is joined to the page so it is returned even past the last entry
+	statement := `WITH matched AS (SELECT * FROM audit_log WHERE ` + strings.Join(conditions, " AND ") + `)
+    SELECT c.total, id, timestamp, action, COALESCE(tag, ''), COALESCE(address, ''), old_value, new_value,
+    COALESCE(before, ''), COALESCE(after, ''), COALESCE(source, ''), COALESCE(actor, ''),
+    COALESCE(client_addr, ''), COALESCE(request_id, '')
+    FROM (SELECT COUNT(*) AS total FROM matched) c
+    LEFT JOIN (SELECT * FROM matched ORDER BY id DESC LIMIT ` + param(limit) + ` OFFSET ` + param(query.Offset) + `) m
+    ORDER BY id DESC`
+	slog.Debug("Querying audit log", "query", query)
+	result, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer result.Close()
+
+	entries = []AuditEntry{}
+	for result.Next() {
+		var entry AuditEntry
+		var id sql.NullInt64
+		var timestamp, action sql.NullString
+		var oldValue, newValue sql.NullFloat64
+		var before, after string
+		err = result.Scan(&total, &id, &timestamp, &action, &entry.Tag, &entry.Address, &oldValue, &newValue,
+			&before, &after, &entry.Source, &entry.Actor, &entry.ClientAddr, &entry.RequestId)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !id.Valid {
+			// Only the count; the page is empty
+			continue
+		}
+		entry.Id, entry.Timestamp, entry.Action = id.Int64, timestamp.String, action.String
+		if oldValue.Valid {
+			entry.OldValue = &oldValue.Float64
+		}
+		if newValue.Valid {
+			entry.NewValue = &newValue.Float64
+		}
+		entry.Before, err = decodeRegister(before)
+		if err != nil {
+			return nil, 0, err
+		}
+		entry.After, err = decodeRegister(after)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, result.Err()
+}
@@ -0,0 +1,160 @@
+package types
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Roles a token can have, each allowing everything the ones before it do
+const (
+	// RoleViewer reads values and tag definitions
+	RoleViewer = "viewer"
+	// RoleOperator also writes values
+	RoleOperator = "operator"
+	// RoleAdmin also changes tags and reloads, backs up and restores the database
+	RoleAdmin = "admin"
+)
+
+var roles = []string{RoleViewer, RoleOperator, RoleAdmin}
+
+// RoleAllows reports whether role grants everything need does
+func RoleAllows(role string, need string) bool {
+	return slices.Contains(roles, role) && slices.Index(roles, role) >= slices.Index(roles, need)
+}
+
+// Secret is a string kept out of logs and printed configurations
+type Secret string
+
+func (s Secret) String() string {
+	return "[redacted]"
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// AuthConfig protects the API with tokens.  Without any tokens the API is open
+// to everyone, as it was before tokens were added.
+type AuthConfig struct {
+	Tokens []ApiToken `json:"tokens,omitempty" yaml:"tokens,omitempty" toml:"tokens,omitempty"`
+	// PublicHealthcheck serves /healthcheck without a token
+	PublicHealthcheck bool `json:"public_healthcheck,omitempty" yaml:"public_healthcheck,omitempty" toml:"public_healthcheck,omitempty"`
+	// AllowedOrigins are the browser origins allowed to call the API, "*" for
+	// any.  Any origin may only read when empty and there are no tokens.
+	AllowedOrigins []string `json:"allowed_origins,omitempty" yaml:"allowed_origins,omitempty" toml:"allowed_origins,omitempty"`
+}
+
+// ApiToken gives the bearer of a secret a role.  Groups give it a different
+// role for the tags at or below each group path, the longest matching path
+// applying, so a token can operate one area and only view the rest.
+type ApiToken struct {
+	// Name identifies the token's holder in logs
+	Name   string            `json:"name" yaml:"name" toml:"name"`
+	Token  Secret            `json:"token" yaml:"token" toml:"token"`
+	Role   string            `json:"role,omitempty" yaml:"role,omitempty" toml:"role,omitempty"`
+	Groups map[string]string `json:"groups,omitempty" yaml:"groups,omitempty" toml:"groups,omitempty"`
+}
+
+// Enabled reports whether requests need a token
+func (a AuthConfig) Enabled() bool {
+	return len(a.Tokens) > 0
+}
+
+// Authenticate finds the token with the given secret
+func (a AuthConfig) Authenticate(secret string) (ApiToken, bool) {
+	// Digests are compared so the time taken doesn't depend on the secrets
+	digest := sha256.Sum256([]byte(secret))
+	var found ApiToken
+	matched := 0
+	for _, token := range a.Tokens {
+		expected := sha256.Sum256([]byte(token.Token))
+		if subtle.ConstantTimeCompare(digest[:], expected[:]) == 1 {
+			found = token
+			matched = 1
+		}
+	}
+	return found, matched == 1 && secret != ""
+}
+
+// AllowsOrigin reports whether a browser on origin has been allowed to call
+// the API
+func (a AuthConfig) AllowsOrigin(origin string) bool {
+	return slices.Contains(a.AllowedOrigins, "*") || slices.Contains(a.AllowedOrigins, origin)
+}
+
+// AllowsAnyReader reports whether browsers on any origin may read from the API,
+// as they could before origins were configured
+func (a AuthConfig) AllowsAnyReader() bool {
+	return len(a.AllowedOrigins) == 0 && !a.Enabled()
+}
+
+// RoleFor returns the token's role for tags in the group at path, or "" if it
+// has none
+func (t ApiToken) RoleFor(path string) string {
+	role, longest := t.Role, -1
+	for group, groupRole := range t.Groups {
+		under := group == "" || path == group || strings.HasPrefix(path, group+"/")
+		if under && len(group) > longest {
+			role, longest = groupRole, len(group)
+		}
+	}
+	return role
+}
+
+// HighestRole returns the most the token allows for any group
+func (t ApiToken) HighestRole() string {
+	highest := t.Role
+	for _, role := range t.Groups {
+		if RoleAllows(role, highest) {
+			highest = role
+		}
+	}
+	return highest
+}
+
+// Redacted returns the configuration with every token's secret hidden
+func (a AuthConfig) Redacted() AuthConfig {
+	a.Tokens = slices.Clone(a.Tokens)
+	for i := range a.Tokens {
+		a.Tokens[i].Token = Secret(a.Tokens[i].Token.String())
+	}
+	return a
+}
+
+// validateAuth checks the tokens have names, distinct secrets and known roles
+func validateAuth(auth AuthConfig) []string {
+	var problems []string
+	secrets := make(map[Secret]string)
+	for i, token := range auth.Tokens {
+		describe := "auth.tokens[" + strconv.Itoa(i) + "] " + strconv.Quote(token.Name)
+		if token.Name == "" {
+			problems = append(problems, describe+": name is empty")
+		}
+		if token.Token == "" {
+			problems = append(problems, describe+": token is empty")
+		} else if other, found := secrets[token.Token]; found {
+			problems = append(problems, describe+": token is also used by "+strconv.Quote(other))
+		} else {
+			secrets[token.Token] = token.Name
+		}
+		if token.Role != "" && !slices.Contains(roles, token.Role) {
+			problems = append(problems, describe+": unknown role "+strconv.Quote(token.Role))
+		}
+		if token.Role == "" && len(token.Groups) == 0 {
+			problems = append(problems, describe+": needs a role or groups")
+		}
+		for group, role := range token.Groups {
+			if !ValidGroupPath(group) {
+				problems = append(problems, describe+": group "+strconv.Quote(group)+" is not a group path")
+			}
+			if !slices.Contains(roles, role) {
+				problems = append(problems, describe+": unknown role "+strconv.Quote(role)+" for group "+strconv.Quote(group))
+			}
+		}
+	}
+	return problems
+}
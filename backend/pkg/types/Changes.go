@@ -0,0 +1,236 @@
+package types
+
+import (
+	"database/sql"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Number of recent changes kept so subscribers can catch up after reconnecting
+const MaxRecentChanges = 1000
+
+// ValueChange is published every time a datapoint's value is written
+type ValueChange struct {
+	Id        uint64  `json:"id"`
+	Tag       string  `json:"tag"`
+	Address   string  `json:"address"`
+	Value     float64 `json:"value"`
+	Timestamp string  `json:"timestamp"`
+	WriteOrigin
+}
+
+// ChangeBus fans value changes out to subscribers.  Publishing never blocks; a
+// subscriber that falls too far behind has its channel closed and is expected
+// to catch up with ChangesSince.
+type ChangeBus struct {
+	mu          sync.Mutex
+	lastId      uint64
+	recent      []ValueChange
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives changes published after it was created on C
+type Subscription struct {
+	C   <-chan ValueChange
+	c   chan ValueChange
+	bus *ChangeBus
+}
+
+func NewChangeBus() *ChangeBus {
+	return &ChangeBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe starts receiving changes with buffer changes of room to fall behind
+func (b *ChangeBus) Subscribe(buffer int) *Subscription {
+	sub, _, _ := b.SubscribeSince(b.LastId(), buffer)
+	return sub
+}
+
+// SubscribeSince starts receiving changes and returns those published after
+// lastId.  complete is false if some of them are no longer retained.
+func (b *ChangeBus) SubscribeSince(lastId uint64, buffer int) (sub *Subscription, missed []ValueChange, complete bool) {
+	c := make(chan ValueChange, buffer)
+	sub = &Subscription{C: c, c: c, bus: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[sub] = struct{}{}
+	missed, complete = b.since(lastId)
+	return sub, missed, complete
+}
+
+// Close stops the subscription and closes its channel
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.unsubscribe(s)
+}
+
+// LastId is the id of the most recently published change
+func (b *ChangeBus) LastId() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastId
+}
+
+// ChangesSince returns the retained changes published after lastId.  complete
+// is false if some of them are no longer retained.
+func (b *ChangeBus) ChangesSince(lastId uint64) (changes []ValueChange, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.since(lastId)
+}
+
+func (b *ChangeBus) since(lastId uint64) ([]ValueChange, bool) {
+	if lastId >= b.lastId {
+		return nil, lastId == b.lastId
+	}
+	if len(b.recent) == 0 || lastId+1 < b.recent[0].Id {
+		return append([]ValueChange(nil), b.recent...), false
+	}
+	first := int(lastId + 1 - b.recent[0].Id)
+	return append([]ValueChange(nil), b.recent[first:]...), true
+}
+
+func (b *ChangeBus) unsubscribe(s *Subscription) {
+	if _, found := b.subscribers[s]; found {
+		delete(b.subscribers, s)
+		close(s.c)
+	}
+}
+
+func (b *ChangeBus) publish(change ValueChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastId++
+	change.Id = b.lastId
+	b.recent = append(b.recent, change)
+	if len(b.recent) > MaxRecentChanges {
+		b.recent = b.recent[len(b.recent)-MaxRecentChanges:]
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub.c <- change:
+		default:
+			slog.Warn("Dropping change subscriber that fell behind")
+			b.unsubscribe(sub)
+		}
+	}
+}
+
+// notifyChange publishes the current value of the datapoint whose column
+// ("address" or "tag") matches key, unless it is write-only.  Changes made in a
+// transaction are held until it commits.
+func (db *SqlDb) notifyChange(column string, key string, origin WriteOrigin) {
+	if db.Changes == nil {
+		return
+	}
+	change := ValueChange{WriteOrigin: origin}
+	var value sql.NullFloat64
+	var access string
+	err := db.QueryRow("SELECT tag, address, value, last_update, COALESCE(access, '') FROM datapoints WHERE "+column+"=$1 AND disabled=0", key).
+		Scan(&change.Tag, &change.Address, &value, &change.Timestamp, &access)
+	if err != nil || !value.Valid || access == AccessWriteOnly {
+		return
+	}
+	change.Value = value.Float64
+	db.queueChange(change)
+}
+
+// registerValue reads the value of the register at address, NULL if it has
+// never been written or isn't configured
+func (db *SqlDb) registerValue(address string) (value sql.NullFloat64) {
+	_ = db.QueryRow("SELECT value FROM datapoints WHERE address=$1 AND disabled=0", address).Scan(&value)
+	return value
+}
+
+// notifyBitChanges publishes the bits of register that a write changed from
+// previous, the register's value before it.  Bit rows take their value from
+// their register, so a write to it as a whole changes them too.  except is a
+// bit whose change has already been published.
+func (db *SqlDb) notifyBitChanges(register string, previous sql.NullFloat64, except string, origin WriteOrigin) {
+	if db.Changes == nil {
+		return
+	}
+	current := db.registerValue(register)
+	if !current.Valid {
+		return
+	}
+	rows, err := db.Query(`SELECT b.tag, b.address, g.last_update, COALESCE(b.access, '') FROM datapoints b
+    JOIN datapoints g ON g.address=$1 AND g.disabled=0
+    WHERE b.address GLOB $1 || '_*' AND b.disabled=0 AND b.address!=$2`, register, except)
+	if err != nil {
+		slog.Warn("Unable to read bits of register", "address", register, "error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		change := ValueChange{WriteOrigin: origin}
+		var access string
+		if err := rows.Scan(&change.Tag, &change.Address, &change.Timestamp, &access); err != nil || access == AccessWriteOnly {
+			continue
+		}
+		_, bit, err := ParseAddress(change.Address)
+		if err != nil {
+			continue
+		}
+		change.Value = float64((uint64(current.Float64) >> bit) & 1)
+		if previous.Valid && float64((uint64(previous.Float64)>>bit)&1) == change.Value {
+			continue
+		}
+		db.queueChange(change)
+	}
+}
+
+// queueChange publishes change, or holds it until the current transaction
+// commits
+func (db *SqlDb) queueChange(change ValueChange) {
+	if db.pending != nil {
+		*db.pending = append(*db.pending, change)
+		return
+	}
+	db.Changes.publish(change)
+}
+
+// addressValues reads the value of every enabled datapoint by address, for
+// notifyValuesChanged to compare against
+func (db *SqlDb) addressValues() (map[string]sql.NullFloat64, error) {
+	rows, err := db.Query("SELECT address, value FROM datapoints WHERE disabled=0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string]sql.NullFloat64)
+	for rows.Next() {
+		var address string
+		var value sql.NullFloat64
+		err = rows.Scan(&address, &value)
+		if err != nil {
+			return nil, err
+		}
+		values[address] = value
+	}
+	return values, rows.Err()
+}
+
+// notifyValuesChanged publishes every enabled datapoint whose value differs
+// from previous, as read by addressValues before a change to many rows.  Bits
+// are published when their register's bit changes, as they are for a write.
+func (db *SqlDb) notifyValuesChanged(previous map[string]sql.NullFloat64, origin WriteOrigin) error {
+	if db.Changes == nil {
+		return nil
+	}
+	current, err := db.addressValues()
+	if err != nil {
+		return err
+	}
+	for address, value := range current {
+		if strings.Contains(address, "_") || value == previous[address] {
+			continue
+		}
+		db.notifyChange("address", address, origin)
+		db.notifyBitChanges(address, previous[address], "", origin)
+	}
+	return nil
+}
@@ -1,44 +1,69 @@
 package types
 
 import (
-	"encoding/json"
 	"log/slog"
-	"os"
 )
 
+// ConfigurationData is the configuration file as written; JSON, YAML and TOML
+// files all share these field names.
 type ConfigurationData struct {
-	ApiPort           int         `json:"api_port"`
-	ModbusPort        int         `json:"modbus_port"`
-	DBPath            string      `json:"db"`
-	Description       string      `json:"description"`
-	Registers         []ModbusTag `json:"registers"`
-	AllowNullRegister bool        `json:"allow_null_register"`
+	ApiPort           int    `json:"api_port" yaml:"api_port" toml:"api_port"`
+	ModbusPort        int    `json:"modbus_port" yaml:"modbus_port" toml:"modbus_port"`
+	DBPath            string `json:"db" yaml:"db" toml:"db"`
+	Description       string `json:"description" yaml:"description" toml:"description"`
+	AllowNullRegister bool   `json:"allow_null_register" yaml:"allow_null_register" toml:"allow_null_register"`
+	OrphanPolicy      string `json:"orphan_policy,omitempty" yaml:"orphan_policy,omitempty" toml:"orphan_policy,omitempty"`
+	// RegistersCsv is a CSV point list loaded in addition to Registers
+	RegistersCsv string `json:"registers_csv,omitempty" yaml:"registers_csv,omitempty" toml:"registers_csv,omitempty"`
+	// Include lists other configuration files whose registers and templates are
+	// added to this one
+	Include []string `json:"include,omitempty" yaml:"include,omitempty" toml:"include,omitempty"`
+	// Templates are named lists of registers with addresses relative to a device
+	Templates map[string][]ModbusTag `json:"templates,omitempty" yaml:"templates,omitempty" toml:"templates,omitempty"`
+	Devices   []Device               `json:"devices,omitempty" yaml:"devices,omitempty" toml:"devices,omitempty"`
+	Registers []ModbusTag            `json:"registers" yaml:"registers" toml:"registers"`
+	// Auth requires tokens to use the API; it is open to everyone without it
+	Auth *AuthConfig `json:"auth,omitempty" yaml:"auth,omitempty" toml:"auth,omitempty"`
 }
 type Configuration struct {
 	ApiPort           int
 	ModbusPort        int
 	DBPath            string
 	AllowNullRegister bool
+	OrphanPolicy      string
+	Auth              AuthConfig
 	Registers         map[InstrumentTag]ModbusTag
 }
 
-func (c Configuration) ReadConfig(fileName string) (Configuration, error) {
-	file, err := os.Open(fileName)
+// ReadConfig loads and validates a configuration file with any overrides applied
+func (c Configuration) ReadConfig(fileName string, overrides ...ConfigOverride) (Configuration, error) {
+	configData, problems, err := ValidateConfigFile(fileName, overrides...)
 	if err != nil {
 		return Configuration{}, err
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	configData := ConfigurationData{}
-	err = decoder.Decode(&configData)
-	if err != nil {
-		return Configuration{}, err
+	if len(problems) > 0 {
+		return Configuration{}, problems
 	}
 	config := configData.dataToConfiguration()
 	slog.Info("Configuration found", "config", config)
 	return config, nil
 }
 
+// ValidateConfigFile loads a configuration file and reports every problem in it
+func ValidateConfigFile(fileName string, overrides ...ConfigOverride) (ConfigurationData, ConfigProblems, error) {
+	configData, sources, err := LoadConfigFile(fileName, overrides...)
+	if err != nil {
+		return ConfigurationData{}, nil, err
+	}
+	problems := ValidateConfiguration(configData, sources)
+	for i := range problems {
+		if problems[i].File == "" {
+			problems[i].File = fileName
+		}
+	}
+	return configData, problems, nil
+}
+
 func (c ConfigurationData) dataToConfiguration() Configuration {
 	config := Configuration{}
 	config.Registers = make(map[InstrumentTag]ModbusTag)
@@ -46,6 +71,10 @@ func (c ConfigurationData) dataToConfiguration() Configuration {
 	config.ModbusPort = c.ModbusPort
 	config.DBPath = c.DBPath
 	config.AllowNullRegister = c.AllowNullRegister
+	config.OrphanPolicy = c.OrphanPolicy
+	if c.Auth != nil {
+		config.Auth = *c.Auth
+	}
 	for _, reg := range c.Registers {
 		config.Registers[InstrumentTag(reg.Tag)] = reg
 	}
@@ -0,0 +1,359 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file formats, selected by file extension
+const (
+	FormatJson = "json"
+	FormatYaml = "yaml"
+	FormatToml = "toml"
+)
+
+// ConfigFormat picks the configuration format from a file name's extension.
+// Files without a known extension are read as JSON, as they always were.
+func ConfigFormat(fileName string) (string, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return FormatYaml, nil
+	case ".toml":
+		return FormatToml, nil
+	}
+	return FormatJson, nil
+}
+
+// LoadConfigFile reads a configuration file and the files it refers to, returning
+// where each register was defined.  Registers are ordered as those in the file,
+// then its devices, included files and registers_csv.  Overrides are applied
+// before the other files are read.
+func LoadConfigFile(fileName string, overrides ...ConfigOverride) (ConfigurationData, []SourceLine, error) {
+	return loadConfigFile(fileName, overrides, nil)
+}
+
+// loadConfigFile loads a configuration file; including lists the files that
+// included it so include loops can be refused
+func loadConfigFile(fileName string, overrides []ConfigOverride, including []string) (ConfigurationData, []SourceLine, error) {
+	absName, err := filepath.Abs(fileName)
+	if err != nil {
+		return ConfigurationData{}, nil, err
+	}
+	if slices.Contains(including, absName) {
+		return ConfigurationData{}, nil, fmt.Errorf("%s: included in a loop", fileName)
+	}
+	including = append(including, absName)
+
+	configData, registerLines, err := DecodeConfigFile(fileName)
+	if err != nil {
+		return ConfigurationData{}, nil, err
+	}
+	err = configData.ApplyOverrides(overrides)
+	if err != nil {
+		return ConfigurationData{}, nil, err
+	}
+	sources := make([]SourceLine, len(configData.Registers))
+	for i := range sources {
+		sources[i].File = fileName
+		if i < len(registerLines) {
+			sources[i].Line = registerLines[i]
+		}
+	}
+
+	// Included files are read first as their templates can be used by our devices
+	var included []ModbusTag
+	var includedSources []SourceLine
+	templates := make(map[string][]ModbusTag)
+	for _, include := range configData.Include {
+		includeData, includeSources, err := loadConfigFile(relativeTo(fileName, include), nil, including)
+		if err != nil {
+			return ConfigurationData{}, nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		for name, template := range includeData.Templates {
+			if _, found := templates[name]; found {
+				return ConfigurationData{}, nil, fmt.Errorf("%s: template %q is defined more than once", fileName, name)
+			}
+			templates[name] = template
+		}
+		included = append(included, includeData.Registers...)
+		includedSources = append(includedSources, includeSources...)
+	}
+	for name, template := range configData.Templates {
+		if _, found := templates[name]; found {
+			return ConfigurationData{}, nil, fmt.Errorf("%s: template %q is defined more than once", fileName, name)
+		}
+		templates[name] = template
+	}
+	configData.Templates = templates
+
+	devices, err := expandDevices(configData.Devices, templates)
+	if err != nil {
+		return ConfigurationData{}, nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	configData.Registers = append(configData.Registers, devices...)
+	for range devices {
+		sources = append(sources, SourceLine{File: fileName})
+	}
+	configData.Registers = append(configData.Registers, included...)
+	sources = append(sources, includedSources...)
+
+	if configData.RegistersCsv != "" {
+		csvPath := relativeTo(fileName, configData.RegistersCsv)
+		registers, csvLines, err := ReadRegistersCsv(csvPath)
+		if err != nil {
+			return ConfigurationData{}, nil, err
+		}
+		configData.Registers = append(configData.Registers, registers...)
+		for _, line := range csvLines {
+			sources = append(sources, SourceLine{File: csvPath, Line: line})
+		}
+	}
+	for i, register := range configData.Registers {
+		configData.Registers[i] = register.ResolveDefault()
+	}
+	return configData, sources, nil
+}
+
+// ErrExternalRegister is returned when saving a register that is defined
+// outside of the configuration file's own registers, such as in registers_csv,
+// an included file or a device template
+var ErrExternalRegister = errors.New("register is not defined in the configuration file")
+
+// SaveRegisters writes a register map back to the configuration file in its
+// own format.  Registers loaded from other files are left where they are and
+// must not have been changed.  Comments are not preserved and overrides are only
+// used to find the register files; they are never written to the file.
+func SaveRegisters(fileName string, registers map[InstrumentTag]ModbusTag, overrides ...ConfigOverride) error {
+	format, err := ConfigFormat(fileName)
+	if err != nil {
+		return err
+	}
+	loaded, sources, err := LoadConfigFile(fileName, overrides...)
+	if err != nil {
+		return err
+	}
+	configData, _, err := DecodeConfigFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	// Keep the existing order of the file, appending new registers at the end
+	external := make(map[string]bool)
+	var order []string
+	for i, register := range loaded.Registers {
+		// The file's own registers are always loaded first
+		if i < len(configData.Registers) {
+			order = append(order, register.Tag)
+			continue
+		}
+		external[register.Tag] = true
+		if current, found := registers[InstrumentTag(register.Tag)]; !found || !reflect.DeepEqual(current, register) {
+			if sources[i].File == fileName {
+				return fmt.Errorf("%w: %s is generated from a device template", ErrExternalRegister, register.Tag)
+			}
+			return fmt.Errorf("%w: %s is defined in %s", ErrExternalRegister, register.Tag, sources[i].File)
+		}
+	}
+	var added []string
+	for tag := range registers {
+		if !external[string(tag)] && !slices.Contains(order, string(tag)) {
+			added = append(added, string(tag))
+		}
+	}
+	slices.Sort(added)
+
+	configData.Registers = []ModbusTag{}
+	for _, tag := range append(order, added...) {
+		if register, found := registers[InstrumentTag(tag)]; found {
+			configData.Registers = append(configData.Registers, register)
+		}
+	}
+	raw, err := EncodeConfig(configData, format)
+	if err != nil {
+		return err
+	}
+
+	// Write alongside and rename so a failed write never leaves half a file
+	temp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(raw)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(fileName); err == nil {
+		_ = os.Chmod(temp.Name(), info.Mode())
+	}
+	return os.Rename(temp.Name(), fileName)
+}
+
+// relativeTo resolves a path referenced from within a configuration file
+func relativeTo(fileName string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(fileName), path)
+}
+
+// DecodeConfigFile reads a configuration file in the format given by its
+// extension along with the line each register starts on
+func DecodeConfigFile(fileName string) (ConfigurationData, []int, error) {
+	format, err := ConfigFormat(fileName)
+	if err != nil {
+		return ConfigurationData{}, nil, err
+	}
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return ConfigurationData{}, nil, err
+	}
+	return DecodeConfig(raw, format)
+}
+
+// DecodeConfig decodes a configuration in the given format along with the
+// line each register starts on, where the format allows us to find it
+func DecodeConfig(raw []byte, format string) (configData ConfigurationData, registerLines []int, err error) {
+	switch format {
+	case FormatJson:
+		err = json.Unmarshal(raw, &configData)
+		registerLines = jsonRegisterLines(raw)
+	case FormatYaml:
+		var document yaml.Node
+		err = yaml.Unmarshal(raw, &document)
+		if err == nil && len(document.Content) > 0 {
+			err = document.Content[0].Decode(&configData)
+			registerLines = yamlRegisterLines(document.Content[0])
+		}
+	case FormatToml:
+		_, err = toml.Decode(string(raw), &configData)
+		registerLines = tomlRegisterLines(raw)
+	default:
+		err = errors.New("Unknown configuration format: " + format)
+	}
+	if err != nil {
+		return ConfigurationData{}, nil, err
+	}
+	return configData, registerLines, nil
+}
+
+// EncodeConfig writes a configuration in the given format
+func EncodeConfig(configData ConfigurationData, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case FormatJson:
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "    ")
+		if err := encoder.Encode(configData); err != nil {
+			return nil, err
+		}
+	case FormatYaml:
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(configData); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	case FormatToml:
+		if err := toml.NewEncoder(&buf).Encode(configData); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Unknown configuration format: " + format)
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonRegisterLines finds the line each entry of the "registers" array starts
+// on so problems can be reported against the file the user edits.
+func jsonRegisterLines(raw []byte) []int {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if key != "registers" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil
+			}
+			continue
+		}
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return nil
+		}
+		var lines []int
+		for dec.More() {
+			offset := dec.InputOffset()
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return lines
+			}
+			lines = append(lines, lineAt(raw, offset))
+		}
+		return lines
+	}
+	return nil
+}
+
+// lineAt returns the line of the first value at or after offset
+func lineAt(raw []byte, offset int64) int {
+	i := int(offset)
+	for i < len(raw) && strings.ContainsRune(" \t\r\n,", rune(raw[i])) {
+		i++
+	}
+	return bytes.Count(raw[:i], []byte("\n")) + 1
+}
+
+// yamlRegisterLines finds the line each entry of the "registers" sequence starts on
+func yamlRegisterLines(root *yaml.Node) []int {
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "registers" || root.Content[i+1].Kind != yaml.SequenceNode {
+			continue
+		}
+		var lines []int
+		for _, register := range root.Content[i+1].Content {
+			lines = append(lines, register.Line)
+		}
+		return lines
+	}
+	return nil
+}
+
+// tomlRegisterLines finds the line of each [[registers]] table.  Registers
+// written as an inline array have no lines reported.
+func tomlRegisterLines(raw []byte) []int {
+	var lines []int
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "[[registers]]" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,97 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of every environment variable overriding a
+// configuration field, e.g. MBSLAVE_API_PORT
+const EnvPrefix = "MBSLAVE_"
+
+// ConfigOverride replaces a top-level configuration field with a value given
+// outside of the configuration file.  Source names where it came from for errors.
+type ConfigOverride struct {
+	Field  string
+	Value  string
+	Source string
+}
+
+// OverrideField is a top-level configuration field that can be overridden
+type OverrideField struct {
+	Name   string
+	Env    string
+	IsBool bool
+	index  int
+}
+
+// OverrideFields lists every top-level field of ConfigurationData holding a
+// single value, named as in the configuration file
+func OverrideFields() []OverrideField {
+	var fields []OverrideField
+	dataType := reflect.TypeOf(ConfigurationData{})
+	for i := 0; i < dataType.NumField(); i++ {
+		field := dataType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		kind := field.Type.Kind()
+		if name == "" || name == "-" || (kind != reflect.String && kind != reflect.Int && kind != reflect.Bool) {
+			continue
+		}
+		fields = append(fields, OverrideField{
+			Name:   name,
+			Env:    EnvPrefix + strings.ToUpper(name),
+			IsBool: field.Type.Kind() == reflect.Bool,
+			index:  i,
+		})
+	}
+	return fields
+}
+
+// EnvOverrides collects the overrides set in the environment using lookup,
+// normally os.LookupEnv
+func EnvOverrides(lookup func(string) (string, bool)) []ConfigOverride {
+	var overrides []ConfigOverride
+	for _, field := range OverrideFields() {
+		if value, found := lookup(field.Env); found {
+			overrides = append(overrides, ConfigOverride{Field: field.Name, Value: value, Source: field.Env})
+		}
+	}
+	return overrides
+}
+
+// ApplyOverrides sets each overridden field in order so later overrides win
+func (c *ConfigurationData) ApplyOverrides(overrides []ConfigOverride) error {
+	fields := make(map[string]OverrideField)
+	for _, field := range OverrideFields() {
+		fields[field.Name] = field
+	}
+	data := reflect.ValueOf(c).Elem()
+	for _, override := range overrides {
+		field, found := fields[override.Field]
+		if !found {
+			return fmt.Errorf("%s: unknown configuration field %q", override.Source, override.Field)
+		}
+		value := data.Field(field.index)
+		switch value.Kind() {
+		case reflect.String:
+			value.SetString(override.Value)
+		case reflect.Int:
+			parsed, err := strconv.Atoi(strings.TrimSpace(override.Value))
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", override.Source, override.Value)
+			}
+			value.SetInt(int64(parsed))
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(strings.TrimSpace(override.Value))
+			if err != nil {
+				return fmt.Errorf("%s: %q is not true or false", override.Source, override.Value)
+			}
+			value.SetBool(parsed)
+		default:
+			return fmt.Errorf("%s: %s can't be overridden", override.Source, override.Field)
+		}
+	}
+	return nil
+}
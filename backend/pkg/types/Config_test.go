@@ -0,0 +1,367 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfigFile = `{
+    "api_port": 8081,
+    "modbus_port": 5502,
+    "registers": [
+        {
+            "tag": "Float1",
+            "address": "40001",
+            "datatype": "float32"
+        },
+        {
+            "tag": "Float2",
+            "address": "40002",
+            "datatype": "float32"
+        },
+        {"tag": "Float1", "address": "40010", "datatype": "uint16"},
+        {"tag": "Unknown", "address": "40011", "datatype": "float16"}
+    ]
+}`
+
+func writeTestConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	_, problems, err := ValidateConfigFile(writeTestConfig(t, testConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		Line    int
+		Message string
+	}{
+		{10, "overlaps"},
+		{15, "duplicate tag"},
+		{16, "unknown datatype"},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Got %d problems, expected %d: %v", len(problems), len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.Line != expected[i].Line || !strings.Contains(problem.Message, expected[i].Message) {
+			t.Errorf("Got %q, expected %v", problem, expected[i])
+		}
+	}
+}
+
+func TestReadConfigRejectsInvalid(t *testing.T) {
+	_, err := Configuration{}.ReadConfig(writeTestConfig(t, testConfigFile))
+	if _, ok := err.(ConfigProblems); !ok {
+		t.Errorf("Got %v, expected configuration problems", err)
+	}
+}
+
+func TestConfigWithoutExtension(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	contents := `{"api_port": 8081, "modbus_port": 5502, "registers": [{"tag": "A", "address": "40001", "datatype": "uint16"}]}`
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := Configuration{}.ReadConfig(path)
+	if err != nil || len(config.Registers) != 1 {
+		t.Errorf("Got %v with %+v, expected the file read as JSON", err, config)
+	}
+}
+
+func TestValidateBitAddresses(t *testing.T) {
+	config := ConfigurationData{
+		ApiPort:    8081,
+		ModbusPort: 5502,
+		Registers: []ModbusTag{
+			{Tag: "Bit0", Address: "10_0", DataType: "digital"},
+			{Tag: "Bit1", Address: "10_1", DataType: "digital"},
+			{Tag: "Bit16", Address: "10_16", DataType: "digital"},
+			{Tag: "Word", Address: "10", DataType: "uint16"},
+		},
+	}
+	problems := ValidateConfiguration(config, nil)
+	if len(problems) != 2 {
+		t.Errorf("Got %v, expected bit range and overlap problems", problems)
+	}
+}
+
+func TestConfigFormatsRoundTrip(t *testing.T) {
+	initial, maximum := 5.0, 250.0
+	float1 := ModbusTag{Tag: "Float1", Description: "Float", Address: "40001", DataType: "float32", MaxAge: "30s",
+		Units: "degC", Max: &maximum, Access: AccessReadOnly, Properties: map[string]string{"loop": "TIC-101"}}
+	original := ConfigurationData{
+		ApiPort:           8081,
+		ModbusPort:        5502,
+		DBPath:            "test.db",
+		AllowNullRegister: true,
+		Registers: []ModbusTag{
+			float1,
+			{Tag: "Bit1", Description: "Bit", Address: "40003_1", DataType: "digital", InitialValue: &initial},
+		},
+	}
+	for _, format := range []string{FormatJson, FormatYaml, FormatToml} {
+		raw, err := EncodeConfig(original, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if strings.Contains(string(raw), "stale_value") {
+			t.Errorf("%s: unset stale_value was written:\n%s", format, raw)
+		}
+		decoded, lines, err := DecodeConfig(raw, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(lines) != 2 {
+			t.Errorf("%s: Got register lines %v, expected 2", format, lines)
+		}
+		if decoded.ApiPort != original.ApiPort || len(decoded.Registers) != 2 ||
+			!reflect.DeepEqual(decoded.Registers[0], float1) ||
+			decoded.Registers[1].InitialValue == nil || *decoded.Registers[1].InitialValue != initial {
+			t.Errorf("%s: Got %+v, expected %+v", format, decoded, original)
+		}
+	}
+}
+
+func TestValidateYamlLines(t *testing.T) {
+	contents := `api_port: 8081
+modbus_port: 5502
+registers:
+  # Flow transmitter
+  - tag: Float1
+    address: "40001"
+    datatype: float32
+  - tag: Float2
+    address: "40002"
+    datatype: float32
+`
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, problems, err := ValidateConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Line != 8 {
+		t.Errorf("Got %v, expected an overlap on line 8", problems)
+	}
+}
+
+func TestLoadRegistersCsv(t *testing.T) {
+	dir := t.TempDir()
+	csvContents := `tag,description,address,datatype,max_age,initial_value
+# Flow transmitters
+FT100,Flow 100,40001,float32,30s,1.5
+FT101,"Flow 101, spare",40002,float32,,
+`
+	if err := os.WriteFile(filepath.Join(dir, "points.csv"), []byte(csvContents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configContents := `{"api_port": 8081, "modbus_port": 5502, "registers_csv": "points.csv", "registers": []}`
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, []byte(configContents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	configData, problems, err := ValidateConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configData.Registers) != 2 {
+		t.Fatalf("Got %d registers, expected 2", len(configData.Registers))
+	}
+	first := configData.Registers[0]
+	if first.Tag != "FT100" || first.MaxAge != "30s" || first.InitialValue == nil || *first.InitialValue != 1.5 {
+		t.Errorf("Got %+v", first)
+	}
+	if configData.Registers[1].Description != "Flow 101, spare" {
+		t.Errorf("Got %q", configData.Registers[1].Description)
+	}
+	// The float32 at 40001 overlaps 40002 and is reported against the csv row
+	if len(problems) != 1 || problems[0].File != filepath.Join(dir, "points.csv") || problems[0].Line != 4 {
+		t.Errorf("Got %v, expected an overlap on points.csv:4", problems)
+	}
+}
+
+func TestDefaultAlias(t *testing.T) {
+	path := writeTestConfig(t, `{"api_port": 8081, "modbus_port": 5502, "registers": [
+        {"tag": "A", "address": "40001", "datatype": "uint16", "default": 4},
+        {"tag": "B", "address": "40002", "datatype": "uint16", "default": 5, "initial_value": 6}
+    ]}`)
+	configData, problems, err := ValidateConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := configData.Registers[0]
+	if first.InitialValue == nil || *first.InitialValue != 4 || first.Default != nil {
+		t.Errorf("Got %+v, expected default moved to initial_value", first)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "give only one") {
+		t.Errorf("Got %v, expected default and initial_value refused together", problems)
+	}
+}
+
+func TestReadRegistersCsvUnknownColumn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "points.csv")
+	if err := os.WriteFile(path, []byte("tag,address,colour\nA,1,red\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadRegistersCsv(path); err == nil {
+		t.Errorf("Expected error for unknown column")
+	}
+}
+
+func TestConfigOverridesPrecedence(t *testing.T) {
+	path := writeTestConfig(t, `{"api_port": 8081, "modbus_port": 5502, "db": "file.db", "registers": []}`)
+	env := map[string]string{"MBSLAVE_API_PORT": "9000", "MBSLAVE_DB": "env.db", "MBSLAVE_ALLOW_NULL_REGISTER": "true"}
+	overrides := EnvOverrides(func(name string) (string, bool) {
+		value, found := env[name]
+		return value, found
+	})
+	overrides = append(overrides, ConfigOverride{Field: "db", Value: "flag.db", Source: "-db"})
+
+	config, err := Configuration{}.ReadConfig(path, overrides...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ApiPort != 9000 || config.ModbusPort != 5502 || config.DBPath != "flag.db" || !config.AllowNullRegister {
+		t.Errorf("Got %+v", config)
+	}
+}
+
+func TestConfigOverrideInvalid(t *testing.T) {
+	path := writeTestConfig(t, `{"api_port": 8081, "modbus_port": 5502, "registers": []}`)
+	_, err := Configuration{}.ReadConfig(path, ConfigOverride{Field: "api_port", Value: "http", Source: "MBSLAVE_API_PORT"})
+	if err == nil || !strings.Contains(err.Error(), "MBSLAVE_API_PORT") {
+		t.Errorf("Got %v, expected an error naming MBSLAVE_API_PORT", err)
+	}
+}
+
+func TestDeviceTemplatesAndIncludes(t *testing.T) {
+	dir := t.TempDir()
+	templates := `
+templates:
+  pump:
+    - {tag: ".Speed", description: "speed", address: "0", datatype: "float32"}
+    - {tag: ".Running", description: "running", address: "2_0", datatype: "digital", path: "Status"}
+`
+	if err := os.WriteFile(filepath.Join(dir, "pumps.yaml"), []byte(templates), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "site.json")
+	site := `{
+    "api_port": 8081,
+    "modbus_port": 5502,
+    "include": ["pumps.yaml"],
+    "devices": [
+        {"template": "pump", "prefix": "P101", "base_address": 100, "description": "Pump 101", "path": "Area1/P101"},
+        {"template": "pump", "prefix": "P102", "base_address": 110}
+    ],
+    "registers": [{"tag": "Site.Flow", "address": "1", "datatype": "uint16"}]
+}`
+	if err := os.WriteFile(path, []byte(site), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := Configuration{}.ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Registers) != 5 {
+		t.Errorf("Got %d registers, expected 5", len(config.Registers))
+	}
+	speed := config.Registers["P101.Speed"]
+	if speed.Address != "100" || speed.Description != "Pump 101 speed" || speed.Path != "Area1/P101" {
+		t.Errorf("Got %+v", speed)
+	}
+	if running := config.Registers["P102.Running"]; running.Address != "112_0" || running.Path != "Status" {
+		t.Errorf("Got %+v", running)
+	}
+	if running := config.Registers["P101.Running"]; running.Path != "Area1/P101/Status" {
+		t.Errorf("Got %+v", running)
+	}
+
+	// Changing a register created from a template can't be saved back to the file
+	config.Registers["P101.Speed"] = ModbusTag{Tag: "P101.Speed", Address: "100", DataType: "float64"}
+	err = SaveRegisters(path, config.Registers)
+	if !errors.Is(err, ErrExternalRegister) {
+		t.Errorf("Got %v, expected %v", err, ErrExternalRegister)
+	}
+}
+
+func TestIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"include": ["b.json"], "registers": []}`), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"include": ["a.json"], "registers": []}`), 0o644)
+	_, _, err := LoadConfigFile(filepath.Join(dir, "a.json"))
+	if err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("Got %v, expected an include loop error", err)
+	}
+}
+
+func TestValidateGroupPaths(t *testing.T) {
+	for path, valid := range map[string]bool{
+		"":                  true,
+		"Area210":           true,
+		"Area210/Unit1/XT1": true,
+		"/Area210":          false,
+		"Area210/":          false,
+		"Area210//Unit1":    false,
+		"Area210/../Unit1":  false,
+	} {
+		problems := ValidateRegisters([]ModbusTag{{Tag: "Tag", Address: "1", DataType: "uint16", Path: path}}, nil)
+		if (len(problems) == 0) != valid {
+			t.Errorf("%q: got %v, expected valid %v", path, problems, valid)
+		}
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	auth := &AuthConfig{Tokens: []ApiToken{
+		{Name: "viewer", Token: "secret", Role: RoleViewer},
+		{Name: "copy", Token: "secret", Role: "superuser"},
+		{Name: "", Token: "", Groups: map[string]string{"Area1/": RoleOperator}},
+	}}
+	problems := ValidateConfiguration(ConfigurationData{ApiPort: 8080, ModbusPort: 5502, Auth: auth}, nil)
+	for _, expected := range []string{"also used by", "unknown role \"superuser\"", "name is empty", "token is empty", "not a group path"} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("Got %v, expected %q", problems, expected)
+		}
+	}
+}
+
+func TestTokenRoles(t *testing.T) {
+	auth := AuthConfig{Tokens: []ApiToken{
+		{Name: "area", Token: "area-secret", Role: RoleViewer, Groups: map[string]string{"Area1": RoleOperator, "Area1/Unit2": RoleViewer}},
+	}}
+	token, found := auth.Authenticate("area-secret")
+	if !found || token.Name != "area" {
+		t.Fatalf("Got %+v %v", token, found)
+	}
+	if _, found := auth.Authenticate(""); found {
+		t.Errorf("Empty token accepted")
+	}
+	for path, role := range map[string]string{"": RoleViewer, "Area1": RoleOperator, "Area1/Unit1": RoleOperator, "Area1/Unit2/XT1": RoleViewer, "Area10": RoleViewer} {
+		if got := token.RoleFor(path); got != role {
+			t.Errorf("%q: got %q, expected %q", path, got, role)
+		}
+	}
+	if token.HighestRole() != RoleOperator || !RoleAllows(RoleAdmin, RoleOperator) || RoleAllows(RoleViewer, RoleOperator) {
+		t.Errorf("Roles aren't ordered")
+	}
+	if printed := fmt.Sprintf("%+v", Configuration{Auth: auth}); strings.Contains(printed, "area-secret") {
+		t.Errorf("Secret printed in %s", printed)
+	}
+}
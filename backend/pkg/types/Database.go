@@ -1,23 +1,38 @@
 package types
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"log/slog"
+	"math"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Connections wait up to 5s for another writer rather than failing with
+// SQLITE_BUSY, and transactions take the write lock as they begin so a batch or
+// Modbus write never has to upgrade a read lock, which fails without waiting
+const dsnOptions = "_busy_timeout=5000&_txlock=immediate"
+
 func (db *SqlDb) Open(dbPath string) error {
 	slog.Info("Opening sqlite3 database at: " + dbPath)
-	newDb, err := sql.Open("sqlite3", dbPath)
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	newDb, err := sql.Open("sqlite3", dbPath+separator+dsnOptions)
 	if err != nil {
 		slog.Error("Could not open sqlite3 db", "error", err.Error())
 		return err
 	}
 	db.DB = newDb
+	db.Changes = NewChangeBus()
 	return nil
 }
 
@@ -40,13 +55,75 @@ func (db *SqlDb) CreateTable() error {
 		slog.Info("Table 'datapoints' already exists ")
 	}
 
-		createTriggerQuery := `
-	CREATE TRIGGER IF NOT EXISTS update_last_update
-	AFTER UPDATE ON datapoints
+	// Columns added after the original schema; older databases are migrated in place
+	for _, column := range [][2]string{
+		{"source", "TEXT"},
+		{"client_addr", "TEXT"},
+		{"request_id", "TEXT"},
+		{"max_age", "REAL DEFAULT 0"},
+		{"on_stale", "TEXT DEFAULT ''"},
+		{"stale_value", "REAL DEFAULT 0"},
+		{"disabled", "INTEGER DEFAULT 0"},
+		{"path", "TEXT DEFAULT ''"},
+		{"units", "TEXT DEFAULT ''"},
+		{"min_value", "REAL"},
+		{"max_value", "REAL"},
+		{"access", "TEXT DEFAULT ''"},
+		{"properties", "TEXT DEFAULT ''"},
+		{"version", "INTEGER DEFAULT 0"},
+		{"actor", "TEXT"},
+	} {
+		err := db.addColumn("datapoints", column[0], column[1])
+		if err != nil {
+			slog.Error("Could not add column", "column", column[0], "error", err)
+			return err
+		}
+	}
+
+	createHistoryQuery := `
+	CREATE TABLE IF NOT EXISTS datapoint_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		address VARCHAR(100) NOT NULL,
+		tag VARCHAR(75) NOT NULL,
+		value REAL,
+		source TEXT,
+		client_addr TEXT,
+		request_id TEXT,
+		timestamp TEXT DEFAULT CURRENT_TIMESTAMP);
+	CREATE INDEX IF NOT EXISTS datapoint_history_address ON datapoint_history (address, id);
+	CREATE TRIGGER IF NOT EXISTS record_history
+	AFTER UPDATE OF value ON datapoints
+	FOR EACH ROW
+	BEGIN
+		INSERT INTO datapoint_history (address, tag, value, source, client_addr, request_id)
+		VALUES (NEW.address, NEW.tag, NEW.value, NEW.source, NEW.client_addr, NEW.request_id);
+		DELETE FROM datapoint_history
+		WHERE address = NEW.address AND id <= (SELECT MAX(id) FROM datapoint_history WHERE address = NEW.address) - ` + strconv.Itoa(MaxHistoryPerAddress) + `;
+	END;
+	`
+	_, err := db.Exec(createHistoryQuery)
+	if err != nil {
+		slog.Error("Could not create history table", "error", err)
+		return err
+	}
+
+	err = db.createAuditLog()
+	if err != nil {
+		slog.Error("Could not create audit log", "error", err)
+		return err
+	}
+
+	// last_update and version track value changes only; older databases had
+	// last_update refreshed by any update, including the tag upserts made at
+	// every startup
+	createTriggerQuery := `
+	DROP TRIGGER IF EXISTS update_last_update;
+	CREATE TRIGGER update_last_update
+	AFTER UPDATE OF value ON datapoints
 	FOR EACH ROW
 	BEGIN
 		UPDATE datapoints
-		SET last_update = CURRENT_TIMESTAMP
+		SET last_update = CURRENT_TIMESTAMP, version = COALESCE(version, 0) + 1
 		WHERE rowid = OLD.rowid;
 	END;
 	`
@@ -59,13 +136,31 @@ func (db *SqlDb) CreateTable() error {
 	return nil
 }
 
-func (db *SqlDb) UpdateTableTags(registers map[InstrumentTag]ModbusTag) {
-	queryStmt := `INSERT INTO datapoints (address,description,tag,datatype) VALUES
-    ($1, $2, $3, $4) 
+// addColumn adds a column to an existing table if it isn't already there
+func (db *SqlDb) addColumn(table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(name) FROM pragma_table_info($1) WHERE name=$2", table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	slog.Info("Adding column", "table", table, "column", column)
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+func (db *SqlDb) UpdateTableTags(registers map[InstrumentTag]ModbusTag) error {
+	queryStmt := `INSERT INTO datapoints (address,description,tag,datatype,max_age,on_stale,stale_value,path,
+    units,min_value,max_value,access,properties,version) VALUES
+    ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) 
     ON CONFLICT(address) DO UPDATE SET
-    description=excluded.description, tag=excluded.tag, datatype=excluded.datatype
+    description=excluded.description, tag=excluded.tag, datatype=excluded.datatype,
+    max_age=excluded.max_age, on_stale=excluded.on_stale, stale_value=excluded.stale_value, path=excluded.path,
+    units=excluded.units, min_value=excluded.min_value, max_value=excluded.max_value, access=excluded.access,
+    properties=excluded.properties, disabled=0
     RETURNING tag;`
-	var err error
 	for _, register := range registers {
 		slog.Debug("Updating row", "reg", register)
 		// Check to see if it's a multibit address.  If it is we create a generic one to r/w to
@@ -77,23 +172,70 @@ func (db *SqlDb) UpdateTableTags(registers map[InstrumentTag]ModbusTag) {
             	Address:     addr,
             	DataType:    "digital",
             }
+			version, err := db.releaseAddress(genReg)
+			if err != nil {
+				return err
+			}
 			err = db.QueryRow(queryStmt, &genReg.Address,
 				&genReg.Description,
-				&genReg.Tag, &genReg.DataType).Scan(&genReg.Tag)
+				&genReg.Tag, &genReg.DataType, 0, "", 0, "", "", nil, nil, "", "", version).Scan(&genReg.Tag)
             slog.Debug("Updating generic address table tag", "reg", genReg)
 			if err != nil {
 				slog.Error("failed to execute generic register query", "error", err)
-				return
+				return err
 			}
 		}
+		maxAge, err := register.MaxAgeDuration()
+		if err != nil {
+			slog.Error("Invalid max_age for tag; staleness disabled", "tag", register.Tag, "max_age", register.MaxAge)
+		}
+		version, err := db.releaseAddress(register)
+		if err != nil {
+			return err
+		}
 		err = db.QueryRow(queryStmt, &register.Address, &register.Description,
-			&register.Tag, &register.DataType).Scan(&register.Tag)
+			&register.Tag, &register.DataType, maxAge.Seconds(), register.OnStale, register.StaleValue, register.Path,
+			register.Units, register.Min, register.Max, register.Access, encodeProperties(register.Properties), version).Scan(&register.Tag)
         slog.Debug("Updating tag", "reg", register)
 		if err != nil {
 			slog.Error("failed to execute query", "error", err)
-			return
+			return err
+		}
+		if register.InitialValue != nil {
+			err = db.applyInitialValue(register)
+			if err != nil {
+				slog.Error("failed to apply initial value", "tag", register.Tag, "error", err)
+			}
 		}
 	}
+	return nil
+}
+
+// releaseAddress removes a row belonging to another tag, enabled or not, from
+// the register's address so the register starts without its value.  The
+// version the register's row should start at is returned; it carries on from
+// the removed row so an ETag for the old value can't match the new one.
+func (db *SqlDb) releaseAddress(register ModbusTag) (version int64, err error) {
+	err = db.QueryRow(`DELETE FROM datapoints WHERE address=$1 AND tag!=$2
+    RETURNING COALESCE(version, 0) + 1`, register.Address, register.Tag).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	slog.Info("Cleared old row for register", "tag", register.Tag, "address", register.Address)
+	return version, nil
+}
+
+// applyInitialValue writes a tag's configured initial value if it has never been given one
+func (db *SqlDb) applyInitialValue(register ModbusTag) error {
+	var uninitialized bool
+	err := db.QueryRow("SELECT value IS NULL FROM datapoints WHERE address=$1", register.Address).Scan(&uninitialized)
+	if err != nil || !uninitialized {
+		return err
+	}
+	slog.Info("Applying initial value", "tag", register.Tag, "value", *register.InitialValue)
+	return db.SetAddressValue(register.Address, *register.InitialValue, WriteOrigin{Source: SourceConfig})
 }
 
 func (db *SqlDb) GetRowByTag(tag string) (response ModbusResponse, err error) {
@@ -108,36 +250,47 @@ func (db *SqlDb) GetRowByTag(tag string) (response ModbusResponse, err error) {
 func (db *SqlDb) GetAddressByTag(tag string) (response string, err error) {
     var resp ModbusResponse
 	slog.Debug("Getting DB Row", "tag", tag)
-	rows := db.QueryRow("SELECT address FROM datapoints WHERE tag=$1", tag)
+	rows := db.QueryRow("SELECT address FROM datapoints WHERE tag=$1 AND disabled=0", tag)
 	err = rows.Scan(&resp.Address)
 
 	return resp.Address, err
 }
 
-func (db *SqlDb) SetTagValue(tag string, value float64) error {
-	slog.Debug("Setting DB Row", "tag", tag, "value", value)
-	_, err := db.Exec("UPDATE datapoints SET value = $1 WHERE tag = $2", value, tag)
-        if err != nil {
-            return err
-        }
+func (db *SqlDb) SetTagValue(tag string, value float64, origin WriteOrigin) error {
+	slog.Debug("Setting DB Row", "tag", tag, "value", value, "origin", origin)
+	err := db.checkWrite("tag", tag, value, origin)
+	if err != nil {
+		return err
+	}
     dataType, err := db.GetDataTypeByTag(tag)
+	if err != nil {
+		return err
+	}
     if strings.Contains(dataType, "digital") {
         addr, err := db.GetAddressByTag(tag)
         if err != nil {
             return err
         }
-        err = db.SetAddressValue(addr, value)
-        if err != nil {
-            return err
-        }
+        // SetAddressValue writes the row once, with its generic register, and
+        // publishes the change for digital tags
+        return db.SetAddressValue(addr, value, origin)
     }
+	address, err := db.GetAddressByTag(tag)
+	if err != nil {
+		return err
+	}
+	previous := db.registerValue(address)
+	_, err = db.Exec("UPDATE datapoints SET value = $1, source = $2, client_addr = $3, request_id = $4, actor = $5 WHERE tag = $6 AND disabled = 0",
+		value, origin.Source, origin.ClientAddr, origin.RequestId, origin.Actor, tag)
 	if err != nil {
 		return err
 	}
+	db.notifyChange("tag", tag, origin)
+	db.notifyBitChanges(address, previous, "", origin)
 	return nil
 }
 
-func (db *SqlDb) SetGenericBitAddress(address string, value float64) error{
+func (db *SqlDb) SetGenericBitAddress(address string, value float64, origin WriteOrigin) error{
         genAddress := strings.Split(address, "_")[0]
 		digitShift, err := strconv.Atoi(strings.Split(address, "_")[1])
 		if err != nil {
@@ -146,7 +299,7 @@ func (db *SqlDb) SetGenericBitAddress(address string, value float64) error{
 
         slog.Debug("Setting generic address", "addr", genAddress, "shift", digitShift, "value", value)
 		currRow, err := db.GetRowByAddress(genAddress)
-		currVal := uint64(currRow.Value)
+		currVal := uint64(currRow.ValueOr(0))
 		intVal := uint64(value)
 		if err != nil && err == sql.ErrNoRows {
             slog.Error("FAILED TO GET ROW", "err", err, "row", currRow)
@@ -158,61 +311,89 @@ func (db *SqlDb) SetGenericBitAddress(address string, value float64) error{
         if intVal > 0 {
 		    currVal |= 1 << uint64(digitShift)
         } else {
-		    currVal &= 0 << uint64(digitShift)
+		    currVal &^= 1 << uint64(digitShift)
         }
 
 	    slog.Debug("Setting generic DB Row", "address", genAddress, "value", currVal)
-		_, err = db.Exec("UPDATE datapoints SET value = $1 WHERE address = $2", currVal, genAddress)
+		previous := db.registerValue(genAddress)
+		_, err = db.Exec("UPDATE datapoints SET value = $1, source = $2, client_addr = $3, request_id = $4, actor = $5 WHERE address = $6 AND disabled = 0",
+			currVal, origin.Source, origin.ClientAddr, origin.RequestId, origin.Actor, genAddress)
 		if err != nil {
 			return err
 		}
+		db.notifyChange("address", genAddress, origin)
+		// The bit written has published its own change
+		db.notifyBitChanges(genAddress, previous, address, origin)
         return nil
 }
 
-func (db *SqlDb) GetGenericBitAddress(address string) (value int, err error) {
-    splitStr := strings.Split(address, "_")
-    genAddress := splitStr[0]
-    if len(splitStr) == 1{
-        return 0, errors.New("Length of address string does not contain digit information")
-    }
-	digitShift, err := strconv.Atoi(strings.Split(address, "_")[1])
-	if err != nil {
-		return 0, err
-	}
-
-    current, err := db.GetRowByAddress(genAddress)
-
-    value = (int(current.Value) >> digitShift) & 1
-
-    if err != nil {
-        slog.Error("Could not find generic address", "addr", genAddress)
-    }
+// bitRegister joins a datapoint d to the generic row g of its register, when
+// d is a bit address
+const bitRegister = `LEFT JOIN datapoints g ON instr(d.address, '_') > 0 AND instr(d.datatype, 'digital') > 0
+    AND g.address = substr(d.address, 1, instr(d.address, '_') - 1) AND g.disabled=0`
 
-    return value, nil
-}
+// datapointValue and datapointLastUpdate select the value of a datapoint d
+// joined by bitRegister and when it was last written.  A bit is read from its
+// register, which Modbus writes as a whole, and is NULL until that is written.
+const (
+	datapointValue = `CASE WHEN g.address IS NOT NULL
+    THEN (CAST(g.value AS INTEGER) >> CAST(substr(d.address, instr(d.address, '_') + 1) AS INTEGER)) & 1
+    ELSE d.value END`
+	datapointLastUpdate = `CASE WHEN g.address IS NOT NULL THEN g.last_update ELSE d.last_update END`
+)
 
 func (db *SqlDb) GetRowByAddress(address string) (response ModbusResponse, err error) {
 	slog.Debug("Getting DB Row", "address", address)
-	rows := db.QueryRow("SELECT address,tag,description,datatype,value,last_update FROM datapoints WHERE address=$1", address)
-	err = rows.Scan(&response.Address, &response.Tag, &response.Description, &response.DataType, &response.Value, &response.LastUpdate)
-    if err != nil && strings.Contains(err.Error(), "NULL to float64") && strings.Contains(response.DataType, "digital") && strings.Contains(response.Address, "_") {
-        err = nil
-        genValue, err := db.GetGenericBitAddress(response.Address)
-        if err != nil {
-            return response, err
-        }
-        response.Value = float64(genValue)
-    } else {
-        return response, err
-    }
+	rows := db.QueryRow(`SELECT d.address,d.tag,d.description,d.datatype,`+datapointValue+`,`+datapointLastUpdate+`,
+    COALESCE(d.source, ''),COALESCE(d.client_addr, ''),COALESCE(d.request_id, ''),COALESCE(d.max_age, 0),COALESCE(d.path, ''),
+    COALESCE(d.units, ''),d.min_value,d.max_value,COALESCE(d.access, ''),COALESCE(d.properties, ''),`+datapointVersion+`
+    FROM datapoints d `+bitRegister+` WHERE d.address=$1 AND d.disabled=0`, address)
+	var value, minimum, maximum sql.NullFloat64
+	var maxAge float64
+	var access, properties string
+	err = rows.Scan(&response.Address, &response.Tag, &response.Description, &response.DataType, &value, &response.LastUpdate,
+		&response.Source, &response.ClientAddr, &response.RequestId, &maxAge, &response.Path,
+		&response.Units, &minimum, &maximum, &access, &properties, &response.Version)
+	if err != nil {
+		return response, err
+	}
+	if value.Valid {
+		response.Value = &value.Float64
+	}
+	response.Initialized = response.Value != nil
+	response.Quality = quality(response.Initialized, response.ValueOr(0), response.LastUpdate, maxAge)
+	err = response.setMetadata(access, minimum, maximum, properties)
 	return
 }
 
+// quality grades a value by whether it has been set and how long ago it was
+// last written compared to the tag's max age (in seconds, 0 to never go stale)
+func quality(valid bool, value float64, lastUpdate string, maxAge float64) string {
+	if !valid {
+		return QualityUninitialized
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return QualityBad
+	}
+	if maxAge <= 0 {
+		return QualityGood
+	}
+	updated, err := time.ParseInLocation(time.DateTime, lastUpdate, time.UTC)
+	if err != nil {
+		slog.Warn("Unable to parse last update", "last_update", lastUpdate, "error", err)
+		return QualityBad
+	}
+	if time.Since(updated).Seconds() > maxAge {
+		return QualityStale
+	}
+	return QualityGood
+}
+
 func (db *SqlDb) GetDataTypeByTag(tag string) (dataType string, err error) {
 
 	slog.Debug("Getting DB Row Datatype", "tag", tag)
 	var db_dataType string = "none"
-	rows := db.QueryRow("SELECT datatype FROM datapoints WHERE tag=$1", tag)
+	rows := db.QueryRow("SELECT datatype FROM datapoints WHERE tag=$1 AND disabled=0", tag)
 	err = rows.Scan(&db_dataType)
 
 	return db_dataType, err
@@ -221,37 +402,87 @@ func (db *SqlDb) GetDataTypeByTag(tag string) (dataType string, err error) {
 func (db *SqlDb) GetDataTypeByAddress(address string) (dataType string, err error) {
 	slog.Debug("Getting DB Row Datatype", "address", address)
 	var db_dataType string = "none"
-	rows := db.QueryRow("SELECT datatype FROM datapoints WHERE address=$1", address)
+	rows := db.QueryRow("SELECT datatype FROM datapoints WHERE address=$1 AND disabled=0", address)
 	err = rows.Scan(&db_dataType)
 
 	return db_dataType, err
 }
 
-func (db *SqlDb) SetAddressValue(address string, value float64) error {
-	slog.Info("Setting DB Row", "address", address, "value", value)
-	_, err := db.Exec("UPDATE datapoints SET value = $1 WHERE address = $2", value, address)
+// GetRowsByAddressRange loads every whole-register row with an address in
+// [start, end) in a single query.  Bit addresses (e.g. "10_2") are skipped as
+// their value is carried by the generic row for the base address, which is
+// write-only if any of its bits are.
+func (db *SqlDb) GetRowsByAddressRange(start int, end int) (map[int]AddressRow, error) {
+	slog.Debug("Getting DB Rows", "start", start, "end", end)
+	rows, err := db.Query(`SELECT address,tag,description,datatype,value,last_update,
+    COALESCE(max_age, 0),COALESCE(on_stale, ''),COALESCE(stale_value, 0),`+registerAccess+` FROM datapoints d
+    WHERE disabled=0 AND address NOT GLOB '*_*' AND CAST(address AS INTEGER) >= $1 AND CAST(address AS INTEGER) < $2`,
+		start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int]AddressRow)
+	for rows.Next() {
+		var row AddressRow
+		var value sql.NullFloat64
+		var maxAge float64
+		err = rows.Scan(&row.Address, &row.Tag, &row.Description, &row.DataType, &value, &row.LastUpdate,
+			&maxAge, &row.OnStale, &row.StaleValue, &row.Access)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := strconv.Atoi(row.Address)
+		if err != nil {
+			slog.Warn("Skipping row with non-numeric address", "address", row.Address)
+			continue
+		}
+		if value.Valid {
+			row.Value = &value.Float64
+		}
+		row.Initialized = value.Valid
+		row.Quality = quality(value.Valid, value.Float64, row.LastUpdate, maxAge)
+		result[addr] = row
+	}
+	return result, rows.Err()
+}
+
+func (db *SqlDb) SetAddressValue(address string, value float64, origin WriteOrigin) error {
+	slog.Info("Setting DB Row", "address", address, "value", value, "origin", origin)
+	err := db.checkWrite("address", address, value, origin)
+	if err != nil {
+		return err
+	}
+	previous := db.registerValue(address)
+	_, err = db.Exec("UPDATE datapoints SET value = $1, source = $2, client_addr = $3, request_id = $4, actor = $5 WHERE address = $6 AND disabled = 0",
+		value, origin.Source, origin.ClientAddr, origin.RequestId, origin.Actor, address)
 	if err != nil {
 		return err
 	}
+	db.notifyChange("address", address, origin)
+	if !strings.Contains(address, "_") {
+		db.notifyBitChanges(address, previous, "", origin)
+	}
     dataType, err := db.GetDataTypeByAddress(address)
     if err != nil {
         return err
     }
 	// If we are sure this is a digital address
 	if strings.Contains(dataType, "digital") && strings.Contains(address, "_") {
-        _ = db.SetGenericBitAddress(address, value)
+        _ = db.SetGenericBitAddress(address, value, origin)
 	}
 	return nil
 }
 
-func (db *SqlDb) PropogateValueSubAddressDigital(address string) error {
+func (db *SqlDb) PropogateValueSubAddressDigital(address string, origin WriteOrigin) error {
     slog.Error("Propogation Nation for"+address)
     currentData, err := db.GetRowByAddress(address)
     if err != nil {
         return err
     }
 
-    newValue := uint64(currentData.Value)
+    newValue := uint64(currentData.ValueOr(0))
 
     rows, err := db.Query("SELECT address FROM datapoints WHERE address LIKE $1", address+"_%")
     if err != nil {
@@ -273,7 +504,7 @@ func (db *SqlDb) PropogateValueSubAddressDigital(address string) error {
             return err
         }
         valToSet := newValue & 1 << digit
-        err = db.SetAddressValue(fullAddress, float64(valToSet))
+        err = db.SetAddressValue(fullAddress, float64(valToSet), origin)
         if err != nil {
             return err
         }
@@ -281,3 +512,214 @@ func (db *SqlDb) PropogateValueSubAddressDigital(address string) error {
     slog.Error("Out of rows")
     return nil
 }
+
+// Backup writes a consistent snapshot of the database to destPath, which must not already exist.
+func (db *SqlDb) Backup(destPath string) error {
+	slog.Info("Backing up database", "path", destPath)
+	_, err := db.Exec("VACUUM INTO $1", destPath)
+	return err
+}
+
+// ValidateSnapshot checks that the file at path is an intact sqlite database
+// with a datapoints table we are able to restore from.
+func ValidateSnapshot(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	snapshot, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	var result string
+	err = snapshot.QueryRow("PRAGMA integrity_check;").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New("Snapshot failed integrity check: " + result)
+	}
+	var count int
+	err = snapshot.QueryRow("SELECT COUNT(name) FROM sqlite_master WHERE type='table' AND name='datapoints';").Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("Snapshot does not contain a datapoints table")
+	}
+	err = snapshot.QueryRow("SELECT COUNT(name) FROM pragma_table_info('datapoints') WHERE name='address';").Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("Snapshot datapoints table has no address column")
+	}
+	return nil
+}
+
+// Restore validates the snapshot at srcPath and replaces the contents of the
+// datapoints table with it, in the current transaction or one of its own.  Only
+// columns that exist in both the snapshot and the live table are copied so older
+// snapshots still restore.  The restore is audited as made by origin and the
+// values it changed are published once the transaction commits.
+func (db *SqlDb) Restore(srcPath string, origin WriteOrigin) (restored int64, err error) {
+	if db.tx == nil {
+		err = db.Transaction(func(tx *SqlDb) (err error) {
+			restored, err = tx.Restore(srcPath, origin)
+			return err
+		})
+		return restored, err
+	}
+	slog.Info("Restoring database", "path", srcPath)
+	err = ValidateSnapshot(srcPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// ATTACH can't be used within a transaction so the snapshot is read on a
+	// connection of its own
+	snapshot, err := sql.Open("sqlite3", "file:"+srcPath+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+	ctx := context.Background()
+	columns, err := commonColumns(ctx, db.tx, snapshot)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := snapshotRows(snapshot, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	previous, err := db.addressValues()
+	if err != nil {
+		return 0, err
+	}
+	var latest int64
+	err = db.QueryRow("SELECT COALESCE(MAX(" + datapointVersion + "), 0) FROM datapoints d").Scan(&latest)
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.Exec("DELETE FROM datapoints")
+	if err != nil {
+		return 0, err
+	}
+	insert := "INSERT INTO datapoints (" + strings.Join(columns, ",") + ") VALUES (" +
+		strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	for _, row := range rows {
+		_, err = db.Exec(insert, row...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// The snapshot's versions were handed out before, so they move past every
+	// version since to keep an ETag read before the restore from matching
+	_, err = db.Exec("UPDATE datapoints SET version = COALESCE(version, 0) + $1", latest+1)
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.Exec(insertAudit, AuditEntry{Action: AuditRestore, WriteOrigin: origin}.insertArgs()...)
+	if err != nil {
+		return 0, err
+	}
+	err = db.notifyValuesChanged(previous, origin)
+	if err != nil {
+		return 0, err
+	}
+	restored = int64(len(rows))
+	slog.Info("Database restored", "path", srcPath, "rows", restored)
+	return restored, nil
+}
+
+// snapshotRows reads columns of every datapoint in snapshot
+func snapshotRows(snapshot *sql.DB, columns []string) (result [][]any, err error) {
+	rows, err := snapshot.Query("SELECT " + strings.Join(columns, ",") + " FROM datapoints")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := make([]any, len(columns))
+		fields := make([]any, len(columns))
+		for i := range row {
+			fields[i] = &row[i]
+		}
+		err = rows.Scan(fields...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// commonColumns lists the datapoints columns of live that snapshot also has
+func commonColumns(ctx context.Context, live queryer, snapshot queryer) (columns []string, err error) {
+	mainColumns, err := tableColumns(ctx, live, "main", "datapoints")
+	if err != nil {
+		return nil, err
+	}
+	snapshotColumns, err := tableColumns(ctx, snapshot, "main", "datapoints")
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range mainColumns {
+		if slices.Contains(snapshotColumns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// tableColumns lists the column names of a table in the given schema
+func tableColumns(ctx context.Context, q queryer, schema string, table string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT name FROM pragma_table_info($1, $2)", table, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// GetHistoryByTag returns the most recent value changes for a tag, newest first
+func (db *SqlDb) GetHistoryByTag(tag string, limit int) ([]HistoryEntry, error) {
+	slog.Debug("Getting DB History", "tag", tag, "limit", limit)
+	rows, err := db.Query(`SELECT tag,address,value,timestamp,
+    COALESCE(source, ''),COALESCE(client_addr, ''),COALESCE(request_id, '')
+    FROM datapoint_history WHERE tag=$1 ORDER BY id DESC LIMIT $2`, tag, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		var value sql.NullFloat64
+		err = rows.Scan(&entry.Tag, &entry.Address, &value, &entry.Timestamp,
+			&entry.Source, &entry.ClientAddr, &entry.RequestId)
+		if err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			entry.Value = &value.Float64
+		}
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
@@ -1,25 +1,159 @@
 package types
 
-import "database/sql"
+import (
+	"database/sql"
+	"maps"
+	"time"
+)
 
 type InstrumentTag string
 
 type ModbusTag struct {
-	Tag         string `json:"tag"`
-	Description string `json:"description"`
-	Address     string `json:"address"`
-	DataType    string `json:"datatype"`
+	Tag         string `json:"tag" yaml:"tag" toml:"tag"`
+	Description string `json:"description" yaml:"description" toml:"description"`
+	Address     string `json:"address" yaml:"address" toml:"address"`
+	DataType    string `json:"datatype" yaml:"datatype" toml:"datatype"`
+	// Path places the tag in a hierarchy of groups such as "Area210/Unit1/XT1055"
+	Path       string   `json:"path,omitempty" yaml:"path,omitempty" toml:"path,omitempty"`
+	MaxAge     string   `json:"max_age,omitempty" yaml:"max_age,omitempty" toml:"max_age,omitempty"`
+	OnStale    string   `json:"on_stale,omitempty" yaml:"on_stale,omitempty" toml:"on_stale,omitempty"`
+	StaleValue *float64 `json:"stale_value,omitempty" yaml:"stale_value,omitempty" toml:"stale_value,omitempty"`
+	// InitialValue is written to the datapoint at startup if it has never been given a value
+	InitialValue *float64 `json:"initial_value,omitempty" yaml:"initial_value,omitempty" toml:"initial_value,omitempty"`
+	// Default is another name for InitialValue, moved into it by ResolveDefault
+	Default *float64 `json:"default,omitempty" yaml:"default,omitempty" toml:"default,omitempty"`
+	// Units of the value, e.g. "degC"
+	Units string `json:"units,omitempty" yaml:"units,omitempty" toml:"units,omitempty"`
+	// Min and Max limit the values written over the API and Modbus
+	Min *float64 `json:"min,omitempty" yaml:"min,omitempty" toml:"min,omitempty"`
+	Max *float64 `json:"max,omitempty" yaml:"max,omitempty" toml:"max,omitempty"`
+	// Access is AccessReadWrite (the default), AccessReadOnly or AccessWriteOnly
+	Access string `json:"access,omitempty" yaml:"access,omitempty" toml:"access,omitempty"`
+	// Properties are free-form metadata returned with the datapoint
+	Properties map[string]string `json:"properties,omitempty" yaml:"properties,omitempty" toml:"properties,omitempty"`
+}
+
+// ResolveDefault moves a value given as default to InitialValue, the name it is
+// stored and written back under.  Both are kept when both are given so
+// validation can refuse them.
+func (t ModbusTag) ResolveDefault() ModbusTag {
+	if t.InitialValue == nil {
+		t.InitialValue, t.Default = t.Default, nil
+	}
+	return t
+}
+
+// Clone copies the tag along with the values its pointers and properties hold,
+// so changing the copy leaves the original as it was
+func (t ModbusTag) Clone() ModbusTag {
+	for _, value := range []**float64{&t.StaleValue, &t.InitialValue, &t.Default, &t.Min, &t.Max} {
+		if *value != nil {
+			copied := **value
+			*value = &copied
+		}
+	}
+	t.Properties = maps.Clone(t.Properties)
+	return t
+}
+
+// MaxAgeDuration parses the tag's max age; an empty max age never goes stale
+func (t ModbusTag) MaxAgeDuration() (time.Duration, error) {
+	if t.MaxAge == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(t.MaxAge)
+}
+
+// Data quality of a datapoint's value
+const (
+	QualityGood          = "good"
+	QualityStale         = "stale"
+	QualityUninitialized = "uninitialized"
+	QualityBad           = "bad"
+)
+
+// What the Modbus slave serves for a stale register
+const (
+	StaleHold       = "hold"
+	StaleSubstitute = "substitute"
+	StaleException  = "exception"
+)
+
+var staleActions = []string{StaleHold, StaleSubstitute, StaleException}
+
+// Sources a value can be written from
+const (
+	SourceApi    = "api"
+	SourceModbus = "modbus"
+	SourceConfig = "config"
+)
+
+// Number of history entries retained per address
+const MaxHistoryPerAddress = 1000
+
+// WriteOrigin records where the most recent write to a datapoint came from
+type WriteOrigin struct {
+	Source     string `json:"source"`
+	ClientAddr string `json:"client_addr"`
+	RequestId  string `json:"request_id"`
+	// Actor names the API token that made the write, when tokens are configured
+	Actor string `json:"actor,omitempty"`
 }
 
 type ModbusResponse struct {
-	Tag         string  `json:"tag"`
-	Description string  `json:"description"`
-	Address     string  `json:"address"`
-	DataType    string  `json:"datatype"`
-	Value       float64 `json:"value"`
-	LastUpdate  string  `json:"last_update"`
+	Tag         string   `json:"tag"`
+	Description string   `json:"description"`
+	Address     string   `json:"address"`
+	DataType    string   `json:"datatype"`
+	Path        string   `json:"path"`
+	Value       *float64 `json:"value"`
+	Initialized bool     `json:"initialized"`
+	LastUpdate  string   `json:"last_update"`
+	Quality     string   `json:"quality"`
+	Units       string   `json:"units"`
+	Min         *float64 `json:"min"`
+	Max         *float64 `json:"max"`
+	// Access is reported as AccessReadWrite when unset.  The value of a
+	// write-only datapoint is always null.
+	Access     string            `json:"access"`
+	Properties map[string]string `json:"properties"`
+	// Version counts the writes to the value, changing with every one.  A bit
+	// also counts the writes to its register.
+	Version int64 `json:"version"`
+	WriteOrigin
+}
+
+// ValueOr returns the datapoint's value, or fallback if it has never been set
+func (r ModbusResponse) ValueOr(fallback float64) float64 {
+	if r.Value == nil {
+		return fallback
+	}
+	return *r.Value
+}
+
+type HistoryEntry struct {
+	Tag     string `json:"tag"`
+	Address string `json:"address"`
+	// Value is nil when the value was cleared
+	Value     *float64 `json:"value"`
+	Timestamp string   `json:"timestamp"`
+	WriteOrigin
+}
+
+// AddressRow is a datapoint row fetched as part of an address range along with
+// its Modbus stale handling.
+type AddressRow struct {
+	ModbusResponse
+	OnStale    string
+	StaleValue float64
 }
 
 type SqlDb struct {
 	*sql.DB
+	// Changes receives every value written to the database
+	Changes *ChangeBus
+	// tx is set for the copy passed to a Transaction callback, along with the
+	// changes to publish once it commits
+	tx      *sql.Tx
+	pending *[]ValueChange
 }
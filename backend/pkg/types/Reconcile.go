@@ -0,0 +1,210 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// What to do with datapoints that are no longer in the configuration
+const (
+	OrphanKeep    = "keep"
+	OrphanDisable = "disable"
+	OrphanArchive = "archive"
+	OrphanDelete  = "delete"
+)
+
+var orphanPolicies = []string{OrphanKeep, OrphanDisable, OrphanArchive, OrphanDelete}
+
+// OrphanedRow is a datapoint left behind by a tag removed from the configuration
+type OrphanedRow struct {
+	Tag     string `json:"tag"`
+	Address string `json:"address"`
+}
+
+// ReconcileReport describes the orphaned rows found and what was done with them
+type ReconcileReport struct {
+	Policy  string        `json:"policy"`
+	Orphans []OrphanedRow `json:"orphans"`
+}
+
+// LogValue summarises the report on one line, naming each orphaned row
+func (r ReconcileReport) LogValue() slog.Value {
+	orphans := make([]string, 0, len(r.Orphans))
+	for _, orphan := range r.Orphans {
+		orphans = append(orphans, orphan.Tag+"@"+orphan.Address)
+	}
+	return slog.GroupValue(slog.String("policy", r.Policy), slog.Int("count", len(r.Orphans)),
+		slog.String("orphans", strings.Join(orphans, ",")))
+}
+
+// ReconcileTags finds datapoints that no longer belong to a configured register
+// and deletes, archives, disables or keeps them according to policy.  Generic
+// rows backing a configured bit address are never orphaned.
+func (db *SqlDb) ReconcileTags(registers map[InstrumentTag]ModbusTag, policy string) (ReconcileReport, error) {
+	if policy == "" {
+		policy = OrphanKeep
+	}
+	report := ReconcileReport{Policy: policy, Orphans: []OrphanedRow{}}
+	if !slices.Contains(orphanPolicies, policy) {
+		return report, errors.New("Unknown orphan policy: " + policy)
+	}
+
+	configured := UsedAddresses(registers)
+	configuredTags := make(map[string]bool, len(registers))
+	for tag := range registers {
+		configuredTags[string(tag)] = true
+	}
+
+	rows, err := db.Query("SELECT tag, address FROM datapoints WHERE disabled=0")
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var orphan OrphanedRow
+		err = rows.Scan(&orphan.Tag, &orphan.Address)
+		if err != nil {
+			rows.Close()
+			return report, err
+		}
+		if !configured[orphan.Address] {
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return report, err
+	}
+
+	for _, orphan := range report.Orphans {
+		action := policy
+		// Two reachable rows can't share a tag, so the row a tag moved away from isn't kept
+		if action == OrphanKeep && configuredTags[orphan.Tag] {
+			action = OrphanDisable
+		}
+		slog.Info("Orphaned datapoint", "tag", orphan.Tag, "address", orphan.Address, "policy", action)
+		switch action {
+		case OrphanDisable:
+			_, err = db.Exec("UPDATE datapoints SET disabled=1 WHERE address=$1", orphan.Address)
+		case OrphanArchive:
+			err = db.archiveRow(orphan.Address)
+		case OrphanDelete:
+			err = db.DeleteAddress(orphan.Address)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// ApplyRegisters brings the datapoints in line with a register map.  Rows the
+// map no longer needs are handled by the orphan policy first, so a tag that
+// moved address never has two enabled rows, and then the changed registers are
+// written, every register when changed is nil.  The tags changed since previous
+// are audited as made by origin.  It should be called in a transaction so a
+// failure part way leaves the database as it was.
+func (db *SqlDb) ApplyRegisters(previous map[InstrumentTag]ModbusTag, registers map[InstrumentTag]ModbusTag,
+	changed map[InstrumentTag]ModbusTag, policy string, origin WriteOrigin) (ReconcileReport, error) {
+	report, err := db.ReconcileTags(registers, policy)
+	if err != nil {
+		return report, err
+	}
+	if changed == nil {
+		changed = registers
+	}
+	if err = db.UpdateTableTags(changed); err != nil {
+		return report, err
+	}
+	return report, db.AuditRegisters(origin, previous, registers)
+}
+
+// UsedAddresses lists the datapoint addresses a register map needs, including
+// the generic rows backing bit addresses
+func UsedAddresses(registers map[InstrumentTag]ModbusTag) map[string]bool {
+	used := make(map[string]bool)
+	for _, register := range registers {
+		used[register.Address] = true
+		if strings.Contains(register.Address, "_") {
+			used[strings.Split(register.Address, "_")[0]] = true
+		}
+	}
+	return used
+}
+
+// DeleteAddress removes a datapoint row
+func (db *SqlDb) DeleteAddress(address string) error {
+	slog.Info("Deleting DB Row", "address", address)
+	_, err := db.Exec("DELETE FROM datapoints WHERE address=$1", address)
+	return err
+}
+
+// archiveRow moves a datapoint into the archive table in a single transaction,
+// the current one if there is one
+func (db *SqlDb) archiveRow(address string) error {
+	if db.tx == nil {
+		return db.Transaction(func(tx *SqlDb) error {
+			return tx.archiveRow(address)
+		})
+	}
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS datapoints_archive AS SELECT * FROM datapoints WHERE 0")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("datapoints_archive", "archived_at", "TEXT")
+	if err != nil {
+		return err
+	}
+	// Keep the archive in step with columns added to datapoints since it was created
+	columns, err := tableColumns(context.Background(), db.tx, "main", "datapoints")
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		err = db.addColumn("datapoints_archive", column, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	columnList := strings.Join(columns, ",")
+	_, err = db.Exec("INSERT INTO datapoints_archive ("+columnList+",archived_at) SELECT "+columnList+
+		",CURRENT_TIMESTAMP FROM datapoints WHERE address=$1", address)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM datapoints WHERE address=$1", address)
+	return err
+}
+
+// RegisterDiff lists the tags that differ between two register maps
+type RegisterDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// DiffRegisters compares the live register map with a replacement for it.
+// Definitions are compared as stored so an empty setting matches a missing one.
+func DiffRegisters(current map[InstrumentTag]ModbusTag, replacement map[InstrumentTag]ModbusTag) RegisterDiff {
+	diff := RegisterDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for tag, register := range replacement {
+		existing, found := current[tag]
+		if !found {
+			diff.Added = append(diff.Added, string(tag))
+		} else if encodeRegister(&existing) != encodeRegister(&register) {
+			diff.Changed = append(diff.Changed, string(tag))
+		}
+	}
+	for tag := range current {
+		if _, found := replacement[tag]; !found {
+			diff.Removed = append(diff.Removed, string(tag))
+		}
+	}
+	slices.Sort(diff.Added)
+	slices.Sort(diff.Removed)
+	slices.Sort(diff.Changed)
+	return diff
+}
@@ -0,0 +1,159 @@
+package types
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Columns written by the export with the current state of each register.  They
+// are ignored on import so an export can be edited and loaded back in.
+var csvStateColumns = []string{"value", "last_update", "quality"}
+
+// csvColumns maps CSV column names to ModbusTag fields.  Columns share the
+// configuration file's field names so every register setting can be given in
+// a spreadsheet without a separate mapping to maintain.
+func csvColumns() (names []string, fields []int) {
+	tagType := reflect.TypeOf(ModbusTag{})
+	for i := 0; i < tagType.NumField(); i++ {
+		name, _, _ := strings.Cut(tagType.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		names = append(names, name)
+		fields = append(fields, i)
+	}
+	return names, fields
+}
+
+// ReadRegistersCsv reads a register map from a CSV file with a header row naming
+// its columns, returning the line each register was defined on.  Lines starting
+// with # are ignored.
+func ReadRegistersCsv(fileName string) ([]ModbusTag, []int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: reading header: %w", fileName, err)
+	}
+
+	names, fields := csvColumns()
+	columns := make([]int, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		columns[i] = -1
+		found := slices.Contains(csvStateColumns, column)
+		for j, name := range names {
+			if name == column {
+				columns[i] = fields[j]
+				found = true
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("%s: unknown column %q", fileName, column)
+		}
+	}
+
+	var registers []ModbusTag
+	var lines []int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		var register ModbusTag
+		value := reflect.ValueOf(&register).Elem()
+		for i, cell := range record {
+			if columns[i] < 0 {
+				continue
+			}
+			err = setCsvField(value.Field(columns[i]), strings.TrimSpace(cell))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: column %q: %w", fileName, line, header[i], err)
+			}
+		}
+		registers = append(registers, register)
+		lines = append(lines, line)
+	}
+	return registers, lines, nil
+}
+
+// setCsvField sets a field from a CSV cell.  Strings are taken as written and
+// anything else is parsed as JSON, so numbers, booleans and objects all work.
+func setCsvField(field reflect.Value, cell string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(cell)
+		return nil
+	}
+	if cell == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(cell), field.Addr().Interface())
+}
+
+// csvCell formats a field for a CSV cell, leaving unset values empty
+func csvCell(field reflect.Value) (string, error) {
+	if field.Kind() == reflect.String {
+		return field.String(), nil
+	}
+	if field.IsZero() {
+		return "", nil
+	}
+	cell, err := json.Marshal(field.Interface())
+	return string(cell), err
+}
+
+// exportColumns are the columns written by the export, leaving out default
+// which is only read as another name for initial_value
+func exportColumns() (names []string, fields []int) {
+	allNames, allFields := csvColumns()
+	for i, name := range allNames {
+		if name != "default" {
+			names = append(names, name)
+			fields = append(fields, allFields[i])
+		}
+	}
+	return names, fields
+}
+
+// RegisterCsvHeader is the header row written by RegisterCsvRecord
+func RegisterCsvHeader() []string {
+	names, _ := exportColumns()
+	return append(names, csvStateColumns...)
+}
+
+// RegisterCsvRecord formats a register and its current value as a CSV row
+func RegisterCsvRecord(register ModbusTag, current ModbusResponse) ([]string, error) {
+	_, fields := exportColumns()
+	value := reflect.ValueOf(register)
+	record := make([]string, 0, len(fields)+3)
+	for _, field := range fields {
+		cell, err := csvCell(value.Field(field))
+		if err != nil {
+			return nil, errors.Join(errors.New("Unable to format "+register.Tag), err)
+		}
+		record = append(record, cell)
+	}
+	currentValue := ""
+	if current.Value != nil {
+		currentValue = fmt.Sprint(*current.Value)
+	}
+	return append(record, currentValue, current.LastUpdate, current.Quality), nil
+}
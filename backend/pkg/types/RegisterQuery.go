@@ -0,0 +1,165 @@
+package types
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// RegisterQuery filters, sorts and pages the datapoints returned by QueryRows
+type RegisterQuery struct {
+	// Only these tags are returned; every enabled datapoint if nil
+	Tags []string
+	// Tag globs such as "Pump*", any of which may match
+	TagPatterns []string
+	// Group path; only tags at or below it are returned
+	Group string
+	// Description glob
+	Description string
+	// Datatypes, any of which may match
+	DataTypes []string
+	// Inclusive range of holding registers, bit addresses included
+	MinAddress *int
+	MaxAddress *int
+	// Sort key, prefixed with "-" for descending order.  Ties are ordered by
+	// address.
+	Sort string
+	// Maximum rows returned, 0 for all of them, after skipping Offset rows
+	Limit  int
+	Offset int
+}
+
+// Expressions each sort key orders by, over the columns of the matched rows
+var registerSortKeys = map[string][]string{
+	"address":     {"register", "bit"},
+	"tag":         {"tag"},
+	"description": {"description"},
+	"datatype":    {"datatype"},
+	"value":       {"value"},
+	"last_update": {"last_update"},
+}
+
+// RegisterSortKeys lists the keys a RegisterQuery can be sorted by
+func RegisterSortKeys() []string {
+	return []string{"address", "tag", "description", "datatype", "value", "last_update"}
+}
+
+// QueryRows returns a page of the datapoints matching query, and how many
+// match in total, from a single query.  Bit addresses without their own value
+// take it from their generic register as in GetRowByAddress.
+func (db *SqlDb) QueryRows(query RegisterQuery) (rows []ModbusResponse, total int, err error) {
+	descending := strings.HasPrefix(query.Sort, "-")
+	sortKey := strings.TrimPrefix(query.Sort, "-")
+	if sortKey == "" {
+		sortKey = "address"
+	}
+	sortColumns, found := registerSortKeys[sortKey]
+	if !found {
+		return nil, 0, errors.New("Unknown sort key: " + sortKey)
+	}
+	var orderBy []string
+	for _, column := range sortColumns {
+		if descending {
+			column += " DESC"
+		}
+		orderBy = append(orderBy, column)
+	}
+	// The address is unique so the order is stable
+	orderBy = append(orderBy, "register", "bit", "address")
+	order := strings.Join(orderBy, ", ")
+
+	var args []any
+	param := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	conditions := []string{"d.disabled=0"}
+	if query.Tags != nil {
+		tags, _ := json.Marshal(query.Tags)
+		conditions = append(conditions, "d.tag IN (SELECT value FROM json_each("+param(string(tags))+"))")
+	}
+	if len(query.TagPatterns) > 0 {
+		patterns, _ := json.Marshal(query.TagPatterns)
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each("+param(string(patterns))+") WHERE d.tag GLOB value)")
+	}
+	if query.Group != "" {
+		group := param(query.Group)
+		conditions = append(conditions, "(d.path = "+group+" OR substr(d.path, 1, length("+group+") + 1) = "+group+" || '/')")
+	}
+	if query.Description != "" {
+		conditions = append(conditions, "d.description GLOB "+param(query.Description))
+	}
+	if len(query.DataTypes) > 0 {
+		dataTypes, _ := json.Marshal(query.DataTypes)
+		conditions = append(conditions, "d.datatype IN (SELECT value FROM json_each("+param(string(dataTypes))+"))")
+	}
+	if query.MinAddress != nil {
+		conditions = append(conditions, "CAST(d.address AS INTEGER) >= "+param(*query.MinAddress))
+	}
+	if query.MaxAddress != nil {
+		conditions = append(conditions, "CAST(d.address AS INTEGER) <= "+param(*query.MaxAddress))
+	}
+	limit := -1
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+
+	// The count is joined to the page so it is returned even past the last row
+	statement := `WITH matched AS (
+    SELECT d.address, d.tag, d.description, d.datatype, `+datapointLastUpdate+` AS last_update,
+    `+datapointValue+` AS value,
+    d.source, d.client_addr, d.request_id, d.max_age, d.path,
+    d.units, d.min_value, d.max_value, d.access, d.properties, `+datapointVersion+` AS version,
+    CAST(d.address AS INTEGER) AS register,
+    CASE WHEN instr(d.address, '_') > 0 THEN CAST(substr(d.address, instr(d.address, '_') + 1) AS INTEGER) ELSE -1 END AS bit
+    FROM datapoints d
+    `+bitRegister+`
+    WHERE ` + strings.Join(conditions, " AND ") + `)
+    SELECT c.total, address, tag, description, datatype, value, last_update,
+    COALESCE(source, ''), COALESCE(client_addr, ''), COALESCE(request_id, ''), COALESCE(max_age, 0), COALESCE(path, ''),
+    COALESCE(units, ''), min_value, max_value, COALESCE(access, ''), COALESCE(properties, ''), COALESCE(version, 0)
+    FROM (SELECT COUNT(*) AS total FROM matched) c
+    LEFT JOIN (SELECT * FROM matched ORDER BY ` + order + ` LIMIT ` + param(limit) + ` OFFSET ` + param(query.Offset) + `) m
+    ORDER BY ` + order
+	slog.Debug("Querying DB Rows", "query", query)
+	result, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer result.Close()
+
+	rows = []ModbusResponse{}
+	for result.Next() {
+		var row ModbusResponse
+		var address, tag, description, dataType, lastUpdate sql.NullString
+		var value, minimum, maximum sql.NullFloat64
+		var maxAge float64
+		var access, properties string
+		err = result.Scan(&total, &address, &tag, &description, &dataType, &value, &lastUpdate,
+			&row.Source, &row.ClientAddr, &row.RequestId, &maxAge, &row.Path,
+			&row.Units, &minimum, &maximum, &access, &properties, &row.Version)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !address.Valid {
+			// Only the count; the page is empty
+			continue
+		}
+		row.Address, row.Tag, row.Description = address.String, tag.String, description.String
+		row.DataType, row.LastUpdate = dataType.String, lastUpdate.String
+		if value.Valid {
+			row.Value = &value.Float64
+		}
+		row.Initialized = row.Value != nil
+		row.Quality = quality(row.Initialized, row.ValueOr(0), row.LastUpdate, maxAge)
+		err = row.setMetadata(access, minimum, maximum, properties)
+		if err != nil {
+			return nil, 0, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, total, result.Err()
+}
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// Device instantiates a register template at a base address.  Each of the
+// template's registers is offset by BaseAddress and has its tag prefixed.
+type Device struct {
+	Template    string `json:"template" yaml:"template" toml:"template"`
+	Prefix      string `json:"prefix" yaml:"prefix" toml:"prefix"`
+	BaseAddress int    `json:"base_address" yaml:"base_address" toml:"base_address"`
+	// Description is prepended to the description of each register
+	Description string `json:"description,omitempty" yaml:"description,omitempty" toml:"description,omitempty"`
+	// Path is the group the device's registers are placed in, ahead of any
+	// path given in the template
+	Path string `json:"path,omitempty" yaml:"path,omitempty" toml:"path,omitempty"`
+}
+
+// expandDevices creates the registers of each device from its template
+func expandDevices(devices []Device, templates map[string][]ModbusTag) ([]ModbusTag, error) {
+	var registers []ModbusTag
+	for i, device := range devices {
+		template, found := templates[device.Template]
+		if !found {
+			return nil, fmt.Errorf("devices[%d]: unknown template %q", i, device.Template)
+		}
+		for _, register := range template {
+			offset, bit, err := ParseAddress(register.Address)
+			if err != nil {
+				return nil, fmt.Errorf("template %q: %q: %w", device.Template, register.Tag, err)
+			}
+			register.Tag = device.Prefix + register.Tag
+			register.Address = strconv.Itoa(device.BaseAddress + offset)
+			if bit >= 0 {
+				register.Address += "_" + strconv.Itoa(bit)
+			}
+			if device.Description != "" {
+				register.Description = device.Description + " " + register.Description
+			}
+			if device.Path != "" {
+				register.Path = path.Join(device.Path, register.Path)
+			}
+			registers = append(registers, register)
+		}
+	}
+	return registers, nil
+}
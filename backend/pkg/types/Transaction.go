@@ -0,0 +1,56 @@
+package types
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Exec runs a statement in the current transaction, if there is one
+func (db *SqlDb) Exec(query string, args ...any) (sql.Result, error) {
+	if db.tx != nil {
+		return db.tx.Exec(query, args...)
+	}
+	return db.DB.Exec(query, args...)
+}
+
+// Query runs a query in the current transaction, if there is one
+func (db *SqlDb) Query(query string, args ...any) (*sql.Rows, error) {
+	if db.tx != nil {
+		return db.tx.Query(query, args...)
+	}
+	return db.DB.Query(query, args...)
+}
+
+// QueryRow runs a single row query in the current transaction, if there is one
+func (db *SqlDb) QueryRow(query string, args ...any) *sql.Row {
+	if db.tx != nil {
+		return db.tx.QueryRow(query, args...)
+	}
+	return db.DB.QueryRow(query, args...)
+}
+
+// Transaction calls fn with a database whose reads and writes all happen in one
+// transaction, committed if fn succeeds and rolled back otherwise
+func (db *SqlDb) Transaction(fn func(tx *SqlDb) error) error {
+	if db.tx != nil {
+		return errors.New("Transactions can't be nested")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var pending []ValueChange
+	err = fn(&SqlDb{DB: db.DB, Changes: db.Changes, tx: tx, pending: &pending})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, change := range pending {
+		db.Changes.publish(change)
+	}
+	return nil
+}
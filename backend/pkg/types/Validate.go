@@ -0,0 +1,226 @@
+package types
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SourceLine locates a register definition in the file it was read from.
+// Line is 0 when it can't be tied to a line of the file.
+type SourceLine struct {
+	File string
+	Line int
+}
+
+func (s SourceLine) String() string {
+	location := s.File
+	if s.Line > 0 {
+		location += ":" + strconv.Itoa(s.Line)
+	}
+	return location
+}
+
+// ConfigProblem is a single issue found while validating a configuration
+type ConfigProblem struct {
+	SourceLine
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if location := p.SourceLine.String(); location != "" {
+		return location + ": " + p.Message
+	}
+	return p.Message
+}
+
+// ConfigProblems collects every problem found in a configuration so they can
+// all be fixed in one pass rather than one restart at a time.
+type ConfigProblems []ConfigProblem
+
+func (p ConfigProblems) Error() string {
+	messages := make([]string, len(p))
+	for i, problem := range p {
+		messages[i] = problem.String()
+	}
+	return "invalid configuration:\n  " + strings.Join(messages, "\n  ")
+}
+
+// DataTypeRegisters returns the number of holding registers a datatype occupies
+func DataTypeRegisters(dataType string) (uint16, error) {
+	// Digital datatypes may carry a bit suffix (e.g. "digital_3")
+	switch strings.Split(dataType, "_")[0] {
+	case "float32":
+		return 2, nil
+	case "float64":
+		return 4, nil
+	case "int16", "uint16", "digital":
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unknown datatype %q", dataType)
+}
+
+// ValidGroupPath reports whether path names a group: segments separated by
+// single slashes, without a leading or trailing slash, or empty for the root
+func ValidGroupPath(path string) bool {
+	if path == "" {
+		return true
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAddress splits a register address into its holding register and, for
+// digital addresses such as "40003_3", the bit within it (-1 otherwise).
+func ParseAddress(address string) (register int, bit int, err error) {
+	base, suffix, isBit := strings.Cut(address, "_")
+	register, err = strconv.Atoi(base)
+	if err != nil || register < 0 || register > 0xffff {
+		return 0, 0, fmt.Errorf("address %q is not a holding register between 0 and 65535", address)
+	}
+	if !isBit {
+		return register, -1, nil
+	}
+	bit, err = strconv.Atoi(suffix)
+	if err != nil || bit < 0 || bit > 15 {
+		return 0, 0, fmt.Errorf("address %q has a bit outside 0-15", address)
+	}
+	return register, bit, nil
+}
+
+// ValidateConfiguration checks a configuration for problems that ReadConfig
+// would otherwise silently accept.  sources holds where each entry of Registers
+// was defined and may be shorter than Registers (or nil) if unknown.
+func ValidateConfiguration(c ConfigurationData, sources []SourceLine) ConfigProblems {
+	problems := ConfigProblems{}
+	add := func(format string, args ...any) {
+		problems = append(problems, ConfigProblem{Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.ApiPort < 1 || c.ApiPort > 0xffff {
+		add("api_port %d is not between 1 and 65535", c.ApiPort)
+	}
+	if c.ModbusPort < 1 || c.ModbusPort > 0xffff {
+		add("modbus_port %d is not between 1 and 65535", c.ModbusPort)
+	}
+	if c.OrphanPolicy != "" && !slices.Contains(orphanPolicies, c.OrphanPolicy) {
+		add("unknown orphan_policy %q", c.OrphanPolicy)
+	}
+	if c.Auth != nil {
+		for _, problem := range validateAuth(*c.Auth) {
+			add("%s", problem)
+		}
+	}
+	return append(problems, ValidateRegisters(c.Registers, sources)...)
+}
+
+// ValidateRegisters checks a register map for duplicate tags and addresses,
+// overlapping registers and invalid settings
+func ValidateRegisters(registers []ModbusTag, sources []SourceLine) ConfigProblems {
+	problems := ConfigProblems{}
+	sourceOf := func(i int) SourceLine {
+		if i < len(sources) {
+			return sources[i]
+		}
+		return SourceLine{}
+	}
+	describe := func(i int) string {
+		return fmt.Sprintf("registers[%d] %q", i, registers[i].Tag)
+	}
+	describeOther := func(i int) string {
+		if source := sourceOf(i); source.Line > 0 {
+			return fmt.Sprintf("%s (%s)", describe(i), source)
+		}
+		return describe(i)
+	}
+	add := func(i int, format string, args ...any) {
+		message := describe(i) + ": " + fmt.Sprintf(format, args...)
+		problems = append(problems, ConfigProblem{SourceLine: sourceOf(i), Message: message})
+	}
+
+	type occupant struct {
+		index int
+		bits  bool
+	}
+	tags := make(map[string]int)
+	addresses := make(map[string]int)
+	occupied := make(map[int]occupant)
+	for i, register := range registers {
+		if register.Tag == "" {
+			add(i, "tag is empty")
+		} else if first, found := tags[register.Tag]; found {
+			add(i, "duplicate tag, also used by %s", describeOther(first))
+		} else {
+			tags[register.Tag] = i
+		}
+
+		if _, err := register.MaxAgeDuration(); err != nil {
+			add(i, "max_age %q is not a duration", register.MaxAge)
+		}
+		if register.OnStale != "" && !slices.Contains(staleActions, register.OnStale) {
+			add(i, "unknown on_stale %q", register.OnStale)
+		}
+		if register.Access != "" && !slices.Contains(accessModes, register.Access) {
+			add(i, "unknown access %q", register.Access)
+		}
+		if register.Min != nil && register.Max != nil && *register.Min > *register.Max {
+			add(i, "min %v is above max %v", *register.Min, *register.Max)
+		}
+		if register.InitialValue != nil && register.Default != nil {
+			add(i, "default and initial_value are the same setting; give only one")
+		}
+		if value := register.InitialValue; value != nil &&
+			(register.Min != nil && *value < *register.Min || register.Max != nil && *value > *register.Max) {
+			add(i, "initial_value %v is outside min and max", *value)
+		}
+		if !ValidGroupPath(register.Path) {
+			add(i, "path %q is not a group path such as \"Area210/Unit1\"", register.Path)
+		}
+
+		count, err := DataTypeRegisters(register.DataType)
+		if err != nil {
+			add(i, "%s", err)
+			continue
+		}
+		base, bit, err := ParseAddress(register.Address)
+		if err != nil {
+			add(i, "%s", err)
+			continue
+		}
+		if first, found := addresses[register.Address]; found {
+			add(i, "duplicate address %s, also used by %s", register.Address, describeOther(first))
+			continue
+		}
+		addresses[register.Address] = i
+
+		// Bit addresses share their holding register with each other but nothing else
+		if bit >= 0 {
+			if !strings.HasPrefix(register.DataType, "digital") {
+				add(i, "bit address %s needs a digital datatype, not %q", register.Address, register.DataType)
+			}
+			if other, found := occupied[base]; found && !other.bits {
+				add(i, "bit address %s overlaps %s", register.Address, describeOther(other.index))
+			} else if !found {
+				occupied[base] = occupant{index: i, bits: true}
+			}
+			continue
+		}
+		if base+int(count) > 0x10000 {
+			add(i, "%s at %d runs past the last holding register", register.DataType, base)
+			continue
+		}
+		for addr := base; addr < base+int(count); addr++ {
+			if other, found := occupied[addr]; found {
+				add(i, "%s at %d overlaps %s at register %d", register.DataType, base, describeOther(other.index), addr)
+				break
+			}
+			occupied[addr] = occupant{index: i}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,55 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrVersionMismatch refuses a conditional write to a datapoint whose version
+// has changed
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// datapointVersion selects the version of a datapoint d.  A bit's value is also
+// written through its register, so its version counts the writes to both.
+const datapointVersion = `COALESCE(d.version, 0) + CASE WHEN instr(d.address, '_') > 0
+    THEN COALESCE((SELECT g.version FROM datapoints g WHERE g.disabled=0
+    AND g.address = substr(d.address, 1, instr(d.address, '_') - 1)), 0) ELSE 0 END`
+
+// SetTagValueIfVersion writes a tag's value only if its version is still
+// version, so concurrent writers can't overwrite each other unseen
+func (db *SqlDb) SetTagValueIfVersion(tag string, value float64, version int64, origin WriteOrigin) error {
+	return db.setValueIfVersion("tag", tag, version, func(tx *SqlDb) error {
+		return tx.SetTagValue(tag, value, origin)
+	})
+}
+
+// SetAddressValueIfVersion writes an address's value only if its version is
+// still version
+func (db *SqlDb) SetAddressValueIfVersion(address string, value float64, version int64, origin WriteOrigin) error {
+	return db.setValueIfVersion("address", address, version, func(tx *SqlDb) error {
+		return tx.SetAddressValue(address, value, origin)
+	})
+}
+
+func (db *SqlDb) setValueIfVersion(column string, key string, version int64, write func(tx *SqlDb) error) error {
+	return db.Transaction(func(tx *SqlDb) error {
+		// Claim the write lock before comparing so a concurrent writer waits
+		// and then sees the new version
+		result, err := tx.Exec("UPDATE datapoints AS d SET version = COALESCE(version, 0) WHERE "+column+"=$1 AND disabled=0 AND "+
+			datapointVersion+"=$2", key, version)
+		if err != nil {
+			return err
+		}
+		if matched, err := result.RowsAffected(); err != nil {
+			return err
+		} else if matched == 0 {
+			var current int64
+			err = tx.QueryRow("SELECT "+datapointVersion+" FROM datapoints d WHERE "+column+"=$1 AND disabled=0", key).Scan(&current)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %s %s is at version %d, not %d", ErrVersionMismatch, column, key, current, version)
+		}
+		return write(tx)
+	})
+}
@@ -0,0 +1,11 @@
+import { env } from '$env/dynamic/private';
+
+/** Adds the API_TOKEN, when the API needs one, to the headers of a request */
+export function apiHeaders(headers = {}) {
+	return env.API_TOKEN ? { ...headers, Authorization: `Bearer ${env.API_TOKEN}` } : headers;
+}
+
+/** Token browsers use for the event stream, which should only be able to view */
+export function eventsToken() {
+	return env.API_EVENTS_TOKEN || '';
+}
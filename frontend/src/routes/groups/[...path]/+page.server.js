@@ -0,0 +1,17 @@
+import { apiHeaders } from '$lib/server/api.js';
+
+/** @type {import('./$types').PageLoad} */
+export async function load({ fetch, params }) {
+	const path = params.path.split('/').map(encodeURIComponent).join('/');
+	const resp = await fetch(`http://127.0.0.1:8081/groups/${path}`, { headers: apiHeaders() });
+	if (resp.ok) {
+		const group = await resp.json();
+		return { group: group };
+	} else {
+		console.error('Failed to fetch group from PI');
+		return {
+			status: resp.status,
+			error: new Error('Failed to fetch group')
+		};
+	}
+}
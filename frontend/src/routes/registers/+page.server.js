@@ -1,9 +1,29 @@
+import { apiHeaders, eventsToken } from '$lib/server/api.js';
+
+// Registers shown per page
+const pageSize = 100;
+
 /** @type {import('./$types').PageLoad} */
-export async function load({ fetch, params }) {
-	const resp = await fetch('http://127.0.0.1:8081/all_registers');
+export async function load({ fetch, url }) {
+	const tag = url.searchParams.get('tag') || '';
+	const page = Math.max(parseInt(url.searchParams.get('page')) || 1, 1);
+	// The API sorts by address, so only the page shown is fetched
+	const query = new URLSearchParams({ limit: pageSize, page: page });
+	if (tag) {
+		query.set('tag', tag);
+	}
+	const resp = await fetch(`http://127.0.0.1:8081/all_registers?${query}`, { headers: apiHeaders() });
 	if (resp.ok) {
 		const data = await resp.json();
-		return { data: data };
+		const total = parseInt(resp.headers.get('X-Total-Count')) || 0;
+		return {
+			data: data,
+			tag: tag,
+			page: page,
+			pages: Math.max(Math.ceil(total / pageSize), 1),
+			total: total,
+			eventsToken: eventsToken()
+		};
 	} else {
 		console.error('Failed to fetch data from PI');
 		return {
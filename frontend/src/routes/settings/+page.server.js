@@ -0,0 +1,26 @@
+import { fail } from '@sveltejs/kit';
+import { apiHeaders } from '$lib/server/api.js';
+
+/** @type {import('./$types').Actions} */
+export const actions = {
+	default: async ({ request, fetch }) => {
+		const form = await request.formData();
+		const tag = {
+			tag: form.get('tag'),
+			description: form.get('description'),
+			address: form.get('address'),
+			datatype: form.get('datatype')
+		};
+		const save = form.get('save') ? '?save=true' : '';
+		const resp = await fetch('http://127.0.0.1:8081/tags' + save, {
+			method: 'POST',
+			headers: apiHeaders({ 'Content-Type': 'application/json' }),
+			body: JSON.stringify(tag)
+		});
+		if (!resp.ok) {
+			console.error('Failed to add tag');
+			return fail(resp.status, { tag: tag, error: await resp.text() });
+		}
+		return { success: true, tag: await resp.json() };
+	}
+};